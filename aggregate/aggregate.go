@@ -8,6 +8,8 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 // Aggregation methods
@@ -19,49 +21,169 @@ const (
 	SUM
 	AVG
 	LAST
+	COUNT
+	FIRST
 )
 
+// Percentiles are stored as PERCENTILE plus the percentile,
+// e.g. PERCENTILE + 99 for the 99th.
+const (
+	PERCENTILE Method = 100
+	MEDIAN            = PERCENTILE + 50
+)
+
+// Percentile returns the method for the pth percentile, 0 < p < 100
+func Percentile(p int) Method {
+	return PERCENTILE + Method(p)
+}
+
+// Quantile is the fraction of values a percentile method
+// is above, false if the method isn't a percentile
+func (m Method) Quantile() (float64, bool) {
+	if m > PERCENTILE && m < PERCENTILE+100 {
+		return float64(m-PERCENTILE) / 100, true
+	}
+	return 0, false
+}
+
+func (m Method) String() string {
+	switch m {
+	case MIN:
+		return "min"
+	case MAX:
+		return "max"
+	case SUM:
+		return "sum"
+	case AVG:
+		return "avg"
+	case LAST:
+		return "last"
+	case COUNT:
+		return "count"
+	case FIRST:
+		return "first"
+	}
+	if _, ok := m.Quantile(); ok {
+		return fmt.Sprintf("p%d", m-PERCENTILE)
+	}
+	return fmt.Sprintf("Method(%d)", int(m))
+}
+
 type Rule struct {
 	name    string
 	pattern *regexp.Regexp
-	Method  Method
+	// The method being read or written, the first of Methods
+	// unless narrowed down with For
+	Method Method
+	// Every method the series is aggregated by
+	Methods []Method
+	// The fraction of a slot's finer intervals that need
+	// a point for the slot to have a value at all
+	XFilesFactor float64
 }
 
 func (r *Rule) String() string { return r.name }
 
+// Has reports whether the series is aggregated by method
+func (r *Rule) Has(method Method) bool {
+	for _, m := range r.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Primary reports whether Method is the first of Methods, which
+// is stored under the path of the series itself
+func (r *Rule) Primary() bool {
+	return len(r.Methods) == 0 || r.Method == r.Methods[0]
+}
+
+// For returns a copy of the rule for reading or writing just method
+func (r *Rule) For(method Method) *Rule {
+	cp := *r
+	cp.Method = method
+	return &cp
+}
+
 type Aggregation struct {
 	rules       []*Rule
 	defaultRule *Rule
 }
 
-func (a *Aggregation) AddDefaultRule(method string) {
+func (a *Aggregation) AddDefaultRule(method string, xFilesFactor float64) {
+	methods := getMethods(method)
 	a.defaultRule = &Rule{
-		Method: getMethod(method),
+		Method:       methods[0],
+		Methods:      methods,
+		XFilesFactor: xFilesFactor,
 	}
 }
 
-func getMethod(method string) Method {
+// getMethods parses a comma separated list of methods
+func getMethods(methods string) []Method {
+	var ms []Method
+	for _, method := range strings.Split(methods, ",") {
+		m, err := ParseMethod(strings.TrimSpace(method))
+		if err != nil {
+			panic(err)
+		}
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// ParseMethod parses a method as written in storage-aggregates.conf,
+// with percentiles written as p50, p90, p99 and so on
+func ParseMethod(method string) (Method, error) {
 	switch method {
 	case "min":
-		return MIN
+		return MIN, nil
 	case "max":
-		return MAX
+		return MAX, nil
 	case "sum":
-		return SUM
-	case "avg":
-	case "average":
-		return AVG
+		return SUM, nil
+	case "avg", "average":
+		return AVG, nil
 	case "last":
-		return LAST
+		return LAST, nil
+	case "count":
+		return COUNT, nil
+	case "first":
+		return FIRST, nil
+	case "median":
+		return MEDIAN, nil
+	}
+	if strings.HasPrefix(method, "p") {
+		if p, err := strconv.Atoi(method[1:]); err == nil && p > 0 && p < 100 {
+			return Percentile(p), nil
+		}
+	}
+	return 0, fmt.Errorf("aggregate: Invalid method %s", method)
+}
+
+// getXFilesFactor parses a fraction between 0 and 1,
+// with nothing at all meaning 0
+func getXFilesFactor(factor string) float64 {
+	if factor == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(factor, 64)
+	if err != nil || f < 0 || f > 1 {
+		panic(fmt.Errorf("aggregate: Invalid xFilesFactor %s", factor))
 	}
-	panic(fmt.Sprintf("aggregate: Invalid method %s", method))
+	return f
 }
 
-func (a *Aggregation) AddRule(name, pattern, method string) {
+func (a *Aggregation) AddRule(name, pattern, method string, xFilesFactor float64) {
+	methods := getMethods(method)
 	rule := &Rule{
-		name:    name,
-		pattern: regexp.MustCompile(pattern),
-		Method:  getMethod(method),
+		name:         name,
+		pattern:      regexp.MustCompile(pattern),
+		Method:       methods[0],
+		Methods:      methods,
+		XFilesFactor: xFilesFactor,
 	}
 	a.rules = append(a.rules, rule)
 }
@@ -82,10 +204,11 @@ func Load(input io.Reader) *Aggregation {
 	}
 	a := &Aggregation{}
 	for k, v := range file {
+		xFilesFactor := getXFilesFactor(v["xFilesFactor"])
 		if k == "default_average" || k == "default" {
-			a.AddDefaultRule(v["aggregationMethod"])
+			a.AddDefaultRule(v["aggregationMethod"], xFilesFactor)
 		} else {
-			a.AddRule(k, v["pattern"], v["aggregationMethod"])
+			a.AddRule(k, v["pattern"], v["aggregationMethod"], xFilesFactor)
 		}
 	}
 	return a
@@ -1,14 +1,21 @@
 package api
 
 import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/export"
 	"github.com/mattrobenolt/mineshaft/index"
 	log "github.com/mattrobenolt/mineshaft/logging"
+	"github.com/mattrobenolt/mineshaft/metric"
+	"github.com/mattrobenolt/mineshaft/schema"
 	"github.com/mattrobenolt/mineshaft/store"
 
+	"bufio"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -52,8 +59,23 @@ func Children(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, resp, http.StatusOK)
 }
 
+// authorized checks the request carries the configured token, as
+// "Authorization: Bearer <token>". Without a token configured,
+// nothing is authorized.
+func authorized(r *http.Request) bool {
+	if authToken == "" {
+		return false
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(authToken)) == 1
+}
+
 func Paths(w http.ResponseWriter, r *http.Request) {
 	log.Println("api:", r)
+	if r.Method == "DELETE" {
+		DeletePaths(w, r)
+		return
+	}
 	if r.URL.Query().Get("query") == "" {
 		invalidRequest(w)
 		return
@@ -87,6 +109,135 @@ func Paths(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, collected, http.StatusOK)
 }
 
+// DeletePaths removes every series matching each query, both its
+// data and its index entries. Pass dry_run=true to only list the
+// series that would be removed.
+func DeletePaths(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		jsonResponse(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	queries := q["query"]
+	if len(queries) == 0 {
+		invalidRequest(w)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(q.Get("dry_run"))
+
+	results := make(map[string]*store.DeleteResult)
+	for _, query := range queries {
+		result, err := appStore.Delete(query, dryRun)
+		if err != nil {
+			// Report what was removed before things went wrong
+			jsonResponse(w, map[string]interface{}{
+				"error":   err.Error(),
+				"deleted": results,
+				"partial": map[string]*store.DeleteResult{query: result},
+			}, http.StatusInternalServerError)
+			return
+		}
+		results[query] = result
+	}
+	jsonResponse(w, results, http.StatusOK)
+}
+
+// Move copies, or merges, series to new paths. Takes from and to
+// prefixes, an optional glob query for the series to move, and
+// merge, delete_source and dry_run flags.
+func Move(w http.ResponseWriter, r *http.Request) {
+	log.Println("api:", r)
+	if r.Method != "POST" {
+		jsonResponse(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		jsonResponse(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	if from == "" || to == "" {
+		invalidRequest(w)
+		return
+	}
+	var opts store.MoveOptions
+	opts.Merge, _ = strconv.ParseBool(q.Get("merge"))
+	opts.DeleteSource, _ = strconv.ParseBool(q.Get("delete_source"))
+	opts.DryRun, _ = strconv.ParseBool(q.Get("dry_run"))
+
+	result, err := appStore.Move(q.Get("query"), from, to, opts)
+	if err != nil {
+		jsonResponse(w, map[string]interface{}{
+			"error":   err.Error(),
+			"partial": result,
+		}, http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, result, http.StatusOK)
+}
+
+// Backfill takes historical points in the carbon plaintext format, one
+// "path value timestamp" per line, and sets every slot they fall in
+// rather than adding to it, so the same data can be sent again safely.
+// Every point of a slot has to be in the same request, and nothing else
+// may be writing to the series at the time, see store.Backfill.
+func Backfill(w http.ResponseWriter, r *http.Request) {
+	log.Println("api:", r)
+	if r.Method != "POST" {
+		jsonResponse(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(r) {
+		jsonResponse(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var points metric.Points
+	defer func() {
+		points.Release()
+	}()
+	scanner := bufio.NewScanner(r.Body)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			jsonResponse(w, fmt.Sprintf("line %d: expected path value timestamp", line), http.StatusBadRequest)
+			return
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			jsonResponse(w, fmt.Sprintf("line %d: %s", line, err), http.StatusBadRequest)
+			return
+		}
+		timestamp, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			jsonResponse(w, fmt.Sprintf("line %d: %s", line, err), http.StatusBadRequest)
+			return
+		}
+		p := metric.New()
+		p.SetPath(fields[0])
+		p.SetValue(value)
+		p.SetTimestamp(uint32(timestamp))
+		points = append(points, p)
+	}
+	if err := scanner.Err(); err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := appStore.Backfill(points)
+	if err != nil {
+		jsonResponse(w, map[string]interface{}{
+			"error":   err.Error(),
+			"partial": result,
+		}, http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, result, http.StatusOK)
+}
+
 func Metrics(w http.ResponseWriter, req *http.Request) {
 	log.Println("api:", req)
 	var (
@@ -116,12 +267,67 @@ func Metrics(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// stitch=true fills each part of the range from the finest bucket
+	// that still has it, consolidated to one step. stitch=segments
+	// returns each of those parts separately with their own step.
+	stitch := q.Get("stitch")
+	segmented := stitch == "segments"
+	stitched, _ := strconv.ParseBool(stitch)
+
+	// resolution=1min reads from that bucket, instead of the finest
+	// one that still retains the whole range
+	var opts store.ReadOptions
+	if resolution := q.Get("resolution"); resolution != "" {
+		if opts.Resolution, err = schema.ParseTime(resolution); err != nil {
+			invalidRequest(w)
+			return
+		}
+	}
+
+	// maxDataPoints=N keeps each series to at most N points,
+	// consolidated by the series' own method or consolidateBy
+	if v := q.Get("maxDataPoints"); v != "" {
+		if opts.MaxDataPoints, err = strconv.Atoi(v); err != nil || opts.MaxDataPoints < 0 {
+			invalidRequest(w)
+			return
+		}
+	}
+	if v := q.Get("consolidateBy"); v != "" {
+		method, err := aggregate.ParseMethod(v)
+		if err != nil {
+			invalidRequest(w)
+			return
+		}
+		opts.ConsolidateBy = &method
+	}
+
+	// agg=max reads that of the methods a series is aggregated by,
+	// as does a target written as path:max
+	if v := q.Get("agg"); v != "" {
+		method, err := aggregate.ParseMethod(v)
+		if err != nil {
+			invalidRequest(w)
+			return
+		}
+		opts.Method = &method
+	}
+
+	if !segmented && !stitched {
+		streamSeries(w, appStore.GetMany(targets, from, to, opts))
+		return
+	}
+
 	var wg sync.WaitGroup
 	series := make(map[string]map[string]interface{})
 	var seriesLock sync.RWMutex
 	defer func() {
 		for _, v := range series {
-			v["series"].(store.NullFloat64s).Release()
+			if data, ok := v["series"].(store.NullFloat64s); ok {
+				data.Release()
+			}
+			if segments, ok := v["segments"].(store.Segments); ok {
+				segments.Release()
+			}
 		}
 	}()
 	for _, t := range targets {
@@ -129,17 +335,21 @@ func Metrics(w http.ResponseWriter, req *http.Request) {
 		go func(t string) {
 			defer wg.Done()
 
-			r, data := appStore.Get(t, from, to)
-			if data == nil {
-				return
+			var result map[string]interface{}
+			if segmented {
+				segments, err := appStore.GetSegments(t, from, to, opts)
+				result = map[string]interface{}{"segments": segments}
+				if err != nil {
+					result["error"] = err.Error()
+				}
+			} else {
+				r, data, err := appStore.GetStitched(t, from, to, opts)
+				if result = seriesResult(r, data, err); result == nil {
+					return
+				}
 			}
 			seriesLock.Lock()
-			series[t] = map[string]interface{}{
-				"from":   r.Lower,
-				"to":     r.Upper,
-				"step":   r.Rollup,
-				"series": data,
-			}
+			series[t] = result
 			seriesLock.Unlock()
 		}(t)
 	}
@@ -147,13 +357,191 @@ func Metrics(w http.ResponseWriter, req *http.Request) {
 	jsonResponse(w, series, http.StatusOK)
 }
 
+// seriesResult is how a single target is rendered by Metrics. A failing
+// target is reported alongside its partial data, without affecting any
+// of the other targets. Returns nil when there's nothing to report.
+func seriesResult(r *schema.Range, data store.NullFloat64s, err error) map[string]interface{} {
+	if data == nil && err == nil {
+		return nil
+	}
+	result := make(map[string]interface{})
+	if r != nil {
+		result["from"] = r.Lower
+		result["to"] = r.Upper
+		result["step"] = r.Rollup
+	}
+	if data != nil {
+		result["series"] = data
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	return result
+}
+
+// streamSeries writes the same JSON object Metrics otherwise would,
+// but flushes each target out as soon as it has been read.
+func streamSeries(w http.ResponseWriter, results <-chan *store.Result) {
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte{'{'})
+	first := true
+	for res := range results {
+		result := seriesResult(res.Range, res.Data, res.Err)
+		if result == nil {
+			continue
+		}
+		key, _ := json.Marshal(res.Path)
+		value, err := json.Marshal(result)
+		res.Data.Release()
+		if err != nil {
+			log.Println("api:", res.Path, err)
+			continue
+		}
+		if !first {
+			w.Write([]byte{','})
+		}
+		first = false
+		w.Write(key)
+		w.Write([]byte{':'})
+		w.Write(value)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	// Always kindly end in a newline
+	w.Write([]byte("}\n"))
+}
+
+// Export streams every point of the series matching query over from-to,
+// out of the finest bucket or the one picked with resolution, as csv,
+// jsonl or wide csv. Points are written as they're read, so an error
+// partway through can only be reported by cutting the response short.
+func Export(w http.ResponseWriter, req *http.Request) {
+	log.Println("api:", req)
+	var (
+		err      error
+		to, from int
+		q        = req.URL.Query()
+		query    = q.Get("query")
+		format   = q.Get("format")
+		opts     store.ExportOptions
+	)
+	if format == "" {
+		format = "csv"
+	}
+	if query == "" {
+		invalidRequest(w)
+		return
+	}
+	if from, err = strconv.Atoi(q.Get("from")); err != nil {
+		invalidRequest(w)
+		return
+	}
+	if to, err = strconv.Atoi(q.Get("to")); err != nil || from > to {
+		invalidRequest(w)
+		return
+	}
+	if resolution := q.Get("resolution"); resolution != "" {
+		if opts.Resolution, err = schema.ParseTime(resolution); err != nil {
+			invalidRequest(w)
+			return
+		}
+	}
+	if v := q.Get("agg"); v != "" {
+		method, err := aggregate.ParseMethod(v)
+		if err != nil {
+			invalidRequest(w)
+			return
+		}
+		opts.Method = &method
+	}
+	out, err := export.NewWriter(format, w)
+	if err != nil {
+		jsonResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.Batch = export.Batch(format)
+
+	started := false
+	err = appStore.Export(query, from, to, opts, func(chunk *store.ExportChunk) error {
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", out.ContentType())
+			w.WriteHeader(http.StatusOK)
+		}
+		if err := out.Write(chunk); err != nil {
+			return err
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if !started {
+			jsonResponse(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Println("api: export of", query, "cut short:", err)
+		return
+	}
+	if !started {
+		w.Header().Set("Content-Type", out.ContentType())
+	}
+	out.Flush()
+}
+
 func Intervals(w http.ResponseWriter, r *http.Request) {
 	target := r.URL.Query().Get("target")
 	buckets := appStore.GetBuckets(target)
 	jsonResponse(w, buckets, http.StatusOK)
 }
 
-var appStore *store.Store
+func Retention(w http.ResponseWriter, r *http.Request) {
+	stats, ok := appStore.RetentionStats()
+	if !ok {
+		jsonResponse(w, "retention not enabled", http.StatusNotFound)
+		return
+	}
+	jsonResponse(w, stats, http.StatusOK)
+}
+
+func Cache(w http.ResponseWriter, r *http.Request) {
+	stats, ok := appStore.CacheStats()
+	if !ok {
+		jsonResponse(w, "cache not enabled", http.StatusNotFound)
+		return
+	}
+	jsonResponse(w, stats, http.StatusOK)
+}
+
+func Dedupe(w http.ResponseWriter, r *http.Request) {
+	stats, ok := appStore.DedupeStats()
+	if !ok {
+		jsonResponse(w, "dedupe not enabled", http.StatusNotFound)
+		return
+	}
+	jsonResponse(w, stats, http.StatusOK)
+}
+
+func Writes(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, appStore.WriteStats(), http.StatusOK)
+}
+
+var (
+	appStore  *store.Store
+	authToken string
+)
+
+// SetAuthToken sets the token required by endpoints that modify data
+func SetAuthToken(token string) {
+	authToken = token
+}
 
 func ListenAndServe(addr string, s *store.Store) error {
 	appStore = s
@@ -164,5 +552,12 @@ func ListenAndServe(addr string, s *store.Store) error {
 	http.HandleFunc("/paths", Paths)
 	http.HandleFunc("/children", Children)
 	http.HandleFunc("/intervals", Intervals)
+	http.HandleFunc("/retention", Retention)
+	http.HandleFunc("/cache", Cache)
+	http.HandleFunc("/dedupe", Dedupe)
+	http.HandleFunc("/writes", Writes)
+	http.HandleFunc("/move", Move)
+	http.HandleFunc("/backfill", Backfill)
+	http.HandleFunc("/export", Export)
 	panic(http.ListenAndServe(addr, nil))
 }
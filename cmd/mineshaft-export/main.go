@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/config"
+	"github.com/mattrobenolt/mineshaft/export"
+	log "github.com/mattrobenolt/mineshaft/logging"
+	"github.com/mattrobenolt/mineshaft/schema"
+	"github.com/mattrobenolt/mineshaft/store"
+
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	query      = flag.String("query", "", "glob of series to export")
+	from       = flag.Int("from", 0, "unix timestamp to export from")
+	to         = flag.Int("to", 0, "unix timestamp to export up to")
+	format     = flag.String("format", "csv", "one of "+strings.Join(export.Formats, ", "))
+	resolution = flag.String("resolution", "", "rollup of the bucket to read, such as 1min, defaults to the finest")
+	agg        = flag.String("agg", "", "aggregation method to read, defaults to the first of each series")
+	output     = flag.String("o", "", "file to write to, defaults to stdout")
+)
+
+func main() {
+	conf, err := config.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *query == "" || *to <= *from {
+		fmt.Fprintln(os.Stderr, "usage: mineshaft-export -query=<glob> -from=<timestamp> -to=<timestamp> [-format=csv|jsonl|wide] [-resolution=<rollup>] [-agg=<method>] [-o=<file>]")
+		os.Exit(2)
+	}
+
+	opts := store.ExportOptions{Batch: export.Batch(*format)}
+	if *resolution != "" {
+		if opts.Resolution, err = schema.ParseTime(*resolution); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *agg != "" {
+		method, err := aggregate.ParseMethod(*agg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Method = &method
+	}
+
+	f := os.Stdout
+	if *output != "" {
+		if f, err = os.Create(*output); err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+	}
+	buf := bufio.NewWriter(f)
+	out, err := export.NewWriter(*format, buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := conf.OpenStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	err = s.Export(*query, *from, *to, opts, out.Write)
+	if flushErr := out.Flush(); err == nil {
+		err = flushErr
+	}
+	if flushErr := buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
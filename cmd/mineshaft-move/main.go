@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/mattrobenolt/mineshaft/config"
+	log "github.com/mattrobenolt/mineshaft/logging"
+	"github.com/mattrobenolt/mineshaft/store"
+
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var (
+	from         = flag.String("from", "", "path, or prefix, to move from")
+	to           = flag.String("to", "", "path, or prefix, to move to")
+	query        = flag.String("query", "", "glob of series to move, defaults to -from")
+	merge        = flag.Bool("merge", false, "merge into series that already exist")
+	deleteSource = flag.Bool("delete", false, "delete the source series once copied")
+	dryRun       = flag.Bool("n", false, "only print what would be moved")
+)
+
+func main() {
+	conf, err := config.Open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *from == "" || *to == "" {
+		fmt.Fprintln(os.Stderr, "usage: mineshaft-move -from=<path> -to=<path> [-query=<glob>] [-merge] [-delete] [-n]")
+		os.Exit(2)
+	}
+
+	s, err := conf.OpenStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	result, err := s.Move(*query, *from, *to, store.MoveOptions{
+		Merge:        *merge,
+		DeleteSource: *deleteSource,
+		DryRun:       *dryRun,
+	})
+	if result != nil {
+		js, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(js))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
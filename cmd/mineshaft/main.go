@@ -5,11 +5,16 @@ import (
 	"github.com/mattrobenolt/mineshaft/carbon"
 	"github.com/mattrobenolt/mineshaft/config"
 	log "github.com/mattrobenolt/mineshaft/logging"
+	"github.com/mattrobenolt/mineshaft/store"
 
 	"fmt"
 	"runtime"
 )
 
+// Points that failed to write, waiting to be logged. Past this
+// they're only counted, in the store's WriteStats.
+const WRITE_ERRORS_BUFFER = 1024
+
 func printBanner() {
 	fmt.Print(`
  ███▄ ▄███▓ ██▓ ███▄    █ ▓█████   ██████  ██░ ██  ▄▄▄        █████▒▄▄▄█████▓
@@ -36,22 +41,35 @@ func main() {
 	}
 	log.Println(conf)
 
-	store, err := conf.OpenStore()
+	s, err := conf.OpenStore()
 	if err != nil {
 		panic(err)
 	}
-	defer store.Close()
+	defer s.Close()
+
+	// Carbon clients get no reply, and batched writes fail long after
+	// Set returns, so failures are logged where they can be seen
+	writeErrors := make(chan *store.WriteError, WRITE_ERRORS_BUFFER)
+	s.SetWriteErrors(writeErrors)
+	go logWriteErrors(writeErrors)
 
 	if conf.CarbonAscii.Enabled {
-		go carbon.ListenAndServeAscii(conf.CarbonAscii.Host+":"+conf.CarbonAscii.Port, store)
+		go carbon.ListenAndServeAscii(conf.CarbonAscii.Host+":"+conf.CarbonAscii.Port, s)
 	}
 	if conf.CarbonPickle.Enabled {
-		go carbon.ListenAndServePickle(conf.CarbonPickle.Host+":"+conf.CarbonPickle.Port, store)
+		go carbon.ListenAndServePickle(conf.CarbonPickle.Host+":"+conf.CarbonPickle.Port, s)
 	}
 	if conf.CarbonProtobuf.Enabled {
-		go carbon.ListenAndServeProtobuf(conf.CarbonProtobuf.Host+":"+conf.CarbonProtobuf.Port, store)
+		go carbon.ListenAndServeProtobuf(conf.CarbonProtobuf.Host+":"+conf.CarbonProtobuf.Port, s)
 	}
 
-	go api.ListenAndServe(conf.Http.Host+":"+conf.Http.Port, store)
+	api.SetAuthToken(conf.Http.AuthToken)
+	go api.ListenAndServe(conf.Http.Host+":"+conf.Http.Port, s)
 	select {}
 }
+
+func logWriteErrors(errs <-chan *store.WriteError) {
+	for e := range errs {
+		log.Error("mineshaft: failed to write %s %v %d: %s", e.Path, e.Value, e.Timestamp, e.Err)
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"github.com/dustin/go-humanize"
 	"github.com/mattrobenolt/mineshaft/aggregate"
 	"github.com/mattrobenolt/mineshaft/index"
 	log "github.com/mattrobenolt/mineshaft/logging"
@@ -9,16 +10,17 @@ import (
 	"github.com/vaughan0/go-ini"
 
 	"flag"
+	"fmt"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var configPath = flag.String("f", "/etc/mineshaft/mineshaft.conf", "configuration file")
 
-func init() {
-	flag.Parse()
-}
-
 type Config struct {
 	CarbonAscii struct {
 		Enabled bool
@@ -36,28 +38,107 @@ type Config struct {
 		Port    string
 	}
 	Http struct {
-		Host string
-		Port string
+		Host      string
+		Port      string
+		AuthToken string
 	}
 	Store struct {
-		Connection *url.URL
-		Schema     string
-		Aggregates string
+		Connection    *url.URL
+		Schema        string
+		Aggregates    string
+		BatchSize     int
+		FlushInterval time.Duration
+		HotWindow     time.Duration
+		HotWindowSize int64
+		Downsample    time.Duration
+		Checkpoint    string
+		Dedupe        time.Duration
+		DedupeSize    int64
+	}
+	Cache struct {
+		Enabled bool
+		Size    int64
+		Ttl     time.Duration
 	}
+	// More stores, by name, for routes to send paths to
+	Stores map[string]*url.URL
+	// Patterns of paths sent to each of Stores, tried in order,
+	// anything not matched goes to Store
+	Routes []Route
+
 	Index struct {
 		Connection *url.URL
 	}
 }
 
+// A Route sends paths matching Pattern to the store named Store
+type Route struct {
+	Store   string
+	Pattern string
+}
+
 func (c *Config) OpenStore() (*store.Store, error) {
 	// TODO(mattrobenolt) better error handling here instead of relying on panics
-	s := store.NewFromConnection(c.Store.Connection)
+	driver, err := c.openDriver()
+	if err != nil {
+		return nil, err
+	}
+	s := store.New(driver)
 	s.SetIndexer(index.NewFromConnection(c.Index.Connection))
 	s.SetSchema(schema.LoadFile(c.Store.Schema))
 	s.SetAggregation(aggregate.LoadFile(c.Store.Aggregates))
+	s.SetBatching(c.Store.BatchSize, c.Store.FlushInterval)
+	s.SetHotWindow(c.Store.HotWindow, c.Store.HotWindowSize)
+	s.SetDedupe(c.Store.Dedupe, c.Store.DedupeSize)
+	if err := s.SetDownsampling(c.Store.Downsample, c.Store.Checkpoint); err != nil {
+		return nil, err
+	}
+	if c.Cache.Enabled {
+		s.SetCache(store.NewCache(store.NewMemoryCache(c.Cache.Size), c.Cache.Ttl))
+	}
 	return s, nil
 }
 
+// openDriver opens the Driver for [store], wrapped in a Router
+// when there are routes to other stores
+func (c *Config) openDriver() (store.Driver, error) {
+	driver, err := store.OpenDriver(c.Store.Connection)
+	if err != nil || len(c.Routes) == 0 {
+		return driver, err
+	}
+	router := store.NewRouter(driver)
+	// Each store is opened once, however many routes lead to it
+	drivers := make(map[string]store.Driver)
+	for _, route := range c.Routes {
+		d, ok := drivers[route.Store]
+		if !ok {
+			u, ok := c.Stores[route.Store]
+			if !ok {
+				router.Close()
+				return nil, fmt.Errorf("config: route to unknown store %q", route.Store)
+			}
+			if d, err = store.OpenDriver(u); err != nil {
+				router.Close()
+				return nil, err
+			}
+			drivers[route.Store] = d
+		}
+		if err = router.AddRoute(route.Store, route.Pattern, d); err != nil {
+			if !ok {
+				d.Close()
+			}
+			router.Close()
+			return nil, err
+		}
+	}
+	for name := range c.Stores {
+		if _, ok := drivers[name]; !ok {
+			log.Println("config: no route to store", name)
+		}
+	}
+	return router, nil
+}
+
 // Load an return a Config object by path
 func LoadFile(path string) (*Config, error) {
 	log.Println("loading config", path)
@@ -87,15 +168,124 @@ func LoadFile(path string) (*Config, error) {
 	}
 	c.Http.Host = file["http"]["host"]
 	c.Http.Port = file["http"]["port"]
+	c.Http.AuthToken = file["http"]["auth_token"]
 	c.Store.Connection, _ = url.Parse(file["store"]["connection"])
 	c.Store.Schema = file["store"]["schema"]
 	c.Store.Aggregates = file["store"]["aggregates"]
+	if v, ok := file["store"]["batch_size"]; ok {
+		if c.Store.BatchSize, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := file["store"]["flush_interval"]; ok {
+		if c.Store.FlushInterval, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := file["store"]["hot_window"]; ok {
+		if c.Store.HotWindow, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+		c.Store.HotWindowSize = 64 << 20
+	}
+	if v, ok := file["store"]["hot_window_size"]; ok {
+		size, err := humanize.ParseBytes(v)
+		if err != nil {
+			return nil, err
+		}
+		c.Store.HotWindowSize = int64(size)
+	}
+	if v, ok := file["store"]["dedupe_window"]; ok {
+		if c.Store.Dedupe, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+		c.Store.DedupeSize = 64 << 20
+	}
+	if v, ok := file["store"]["dedupe_size"]; ok {
+		size, err := humanize.ParseBytes(v)
+		if err != nil {
+			return nil, err
+		}
+		c.Store.DedupeSize = int64(size)
+	}
+	if v, ok := file["store"]["downsample"]; ok {
+		if c.Store.Downsample, err = time.ParseDuration(v); err != nil {
+			return nil, err
+		}
+		c.Store.Checkpoint = "rollups.json"
+	}
+	if v, ok := file["store"]["checkpoint"]; ok {
+		c.Store.Checkpoint = v
+	}
+	if _, ok := file["cache"]; ok {
+		c.Cache.Enabled = true
+		c.Cache.Size = 256 << 20
+		c.Cache.Ttl = time.Hour
+		if v, ok := file["cache"]["size"]; ok {
+			size, err := humanize.ParseBytes(v)
+			if err != nil {
+				return nil, err
+			}
+			c.Cache.Size = int64(size)
+		}
+		if v, ok := file["cache"]["ttl"]; ok {
+			if c.Cache.Ttl, err = time.ParseDuration(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c.Stores = make(map[string]*url.URL)
+	for name, connection := range file["stores"] {
+		if c.Stores[name], err = url.Parse(connection); err != nil {
+			return nil, err
+		}
+	}
+	if c.Routes, err = parseRoutes(file["routes"]); err != nil {
+		return nil, err
+	}
 	c.Index.Connection, _ = url.Parse(file["index"]["connection"])
 	return &c, nil
 }
 
+// parseRoutes reads [routes], where each route is keyed by its
+// position, and is the name of a store followed by a pattern, e.g.
+//
+//	1 = cheap ^deploy\.
+//	2 = cheap ^puppet\.reports\.
+//
+// Routes are returned in order of position, which is the order
+// they're tried in, so the first matching pattern wins.
+func parseRoutes(section ini.Section) ([]Route, error) {
+	positions := make([]int, 0, len(section))
+	byPosition := make(map[int]Route, len(section))
+	for key, value := range section {
+		position, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("config: route %q isn't numbered", key)
+		}
+		value = strings.TrimSpace(value)
+		end := strings.IndexAny(value, " \t")
+		if end < 0 {
+			return nil, fmt.Errorf("config: route %d needs a store and a pattern", position)
+		}
+		positions = append(positions, position)
+		byPosition[position] = Route{value[:end], strings.TrimSpace(value[end:])}
+	}
+	sort.Ints(positions)
+	routes := make([]Route, len(positions))
+	for i, position := range positions {
+		routes[i] = byPosition[position]
+	}
+	return routes, nil
+}
+
 // Open the global configuration file
 func Open() (*Config, error) {
+	// Parsed here rather than at init, so commands
+	// can declare flags of their own
+	if !flag.Parsed() {
+		flag.Parse()
+	}
 	var err error
 	if appConfig == nil {
 		appConfig, err = LoadFile(*configPath)
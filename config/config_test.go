@@ -0,0 +1,37 @@
+package config
+
+import (
+	"github.com/vaughan0/go-ini"
+
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := parseRoutes(ini.Section{
+		"10": `cheap ^puppet\.reports\.`,
+		"2":  `archive ^old\.`,
+		"1":  "cheap\t^deploy\\.",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In order of number, not of key
+	want := []Route{{"cheap", `^deploy\.`}, {"archive", `^old\.`}, {"cheap", `^puppet\.reports\.`}}
+	if len(routes) != len(want) {
+		t.Fatalf("parseRoutes = %v, want %v", routes, want)
+	}
+	for i := range want {
+		if routes[i] != want[i] {
+			t.Errorf("route %d = %v, want %v", i, routes[i], want[i])
+		}
+	}
+
+	for _, section := range []ini.Section{
+		{"cheap": `^deploy\.`},
+		{"1": "cheap"},
+	} {
+		if _, err := parseRoutes(section); err == nil {
+			t.Errorf("parseRoutes(%v) succeeded", section)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Package export writes series read with store.Store.Export out as
+// CSV or JSON Lines, a chunk at a time, as they're read.
+package export
+
+import (
+	"github.com/mattrobenolt/mineshaft/store"
+
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// How many series are read together for formats with a row per point
+const BATCH_SERIES = 100
+
+// Batch is how many series to export at a time in format,
+// as store.ExportOptions.Batch
+func Batch(format string) int {
+	if format == "wide" {
+		return 0
+	}
+	return BATCH_SERIES
+}
+
+// Writer writes out each chunk of an export in some format
+type Writer interface {
+	Write(*store.ExportChunk) error
+	// Flush writes out anything still buffered
+	Flush() error
+	// The Content-Type of what's written
+	ContentType() string
+}
+
+// Formats lists every format NewWriter accepts
+var Formats = []string{"csv", "jsonl", "wide"}
+
+// NewWriter returns a Writer for format. With csv, each point is a row
+// of path, timestamp and value, and with jsonl a line of JSON with those
+// same fields. With wide, each row is a timestamp followed by the value of
+// every series at that time, one column per series, left empty where a
+// series has no point. Wide exports need every series in each chunk, so
+// have to be exported in a single batch.
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case "csv":
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case "jsonl":
+		return &jsonWriter{w: bufio.NewWriter(w)}, nil
+	case "wide":
+		return &wideWriter{w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("export: unknown format %q", format)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (c *csvWriter) Write(chunk *store.ExportChunk) error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write([]string{"path", "timestamp", "value"}); err != nil {
+			return err
+		}
+	}
+	row := make([]string, 3)
+	for i, path := range chunk.Paths {
+		for j, v := range chunk.Data[i] {
+			if v == nil || !v.Valid {
+				continue
+			}
+			row[0] = path
+			row[1] = strconv.Itoa(chunk.Lower + j*chunk.Rollup)
+			row[2] = formatValue(v.Float64)
+			if err := c.w.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) ContentType() string {
+	return "text/csv"
+}
+
+type jsonWriter struct {
+	w *bufio.Writer
+}
+
+type jsonPoint struct {
+	Path      string  `json:"path"`
+	Timestamp int     `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+func (j *jsonWriter) Write(chunk *store.ExportChunk) error {
+	enc := json.NewEncoder(j.w)
+	for i, path := range chunk.Paths {
+		for k, v := range chunk.Data[i] {
+			if v == nil || !v.Valid {
+				continue
+			}
+			if err := enc.Encode(jsonPoint{path, chunk.Lower + k*chunk.Rollup, v.Float64}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (j *jsonWriter) Flush() error {
+	return j.w.Flush()
+}
+
+func (j *jsonWriter) ContentType() string {
+	return "application/x-ndjson"
+}
+
+type wideWriter struct {
+	w     *csv.Writer
+	paths []string
+}
+
+func (c *wideWriter) Write(chunk *store.ExportChunk) error {
+	if c.paths == nil {
+		c.paths = chunk.Paths
+		if err := c.w.Write(append([]string{"timestamp"}, c.paths...)); err != nil {
+			return err
+		}
+	} else if len(chunk.Paths) != len(c.paths) || chunk.Paths[0] != c.paths[0] {
+		return fmt.Errorf("export: wide exports need every series in a single batch")
+	}
+	row := make([]string, len(c.paths)+1)
+	slots := 0
+	for _, data := range chunk.Data {
+		if len(data) > slots {
+			slots = len(data)
+		}
+	}
+	for j := 0; j < slots; j++ {
+		any := false
+		for i, data := range chunk.Data {
+			row[i+1] = ""
+			if j < len(data) && data[j] != nil && data[j].Valid {
+				row[i+1] = formatValue(data[j].Float64)
+				any = true
+			}
+		}
+		if !any {
+			continue
+		}
+		row[0] = strconv.Itoa(chunk.Lower + j*chunk.Rollup)
+		if err := c.w.Write(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *wideWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *wideWriter) ContentType() string {
+	return "text/csv"
+}
@@ -0,0 +1,86 @@
+package export
+
+import (
+	"github.com/mattrobenolt/mineshaft/store"
+
+	"bytes"
+	"testing"
+)
+
+func chunk(paths []string, lower int, values ...[]interface{}) *store.ExportChunk {
+	c := &store.ExportChunk{Paths: paths, Lower: lower, Rollup: 60}
+	for _, vs := range values {
+		data := make(store.NullFloat64s, len(vs))
+		for i, v := range vs {
+			if f, ok := v.(float64); ok {
+				data[i] = store.NewNullFloat64(f, true)
+			}
+		}
+		c.Data = append(c.Data, data)
+	}
+	return c
+}
+
+func TestWriters(t *testing.T) {
+	paths := []string{"a.x", "a.y"}
+	chunks := []*store.ExportChunk{
+		chunk(paths, 0, []interface{}{1.0, nil}, []interface{}{nil, 2.5}),
+		chunk(paths, 120, []interface{}{nil, nil}, []interface{}{-3.0, nil}),
+	}
+	defer func() {
+		for _, c := range chunks {
+			c.Release()
+		}
+	}()
+
+	for _, tc := range []struct {
+		format, contentType, want string
+	}{
+		{"csv", "text/csv", "path,timestamp,value\na.x,0,1\na.y,60,2.5\na.y,120,-3\n"},
+		{"jsonl", "application/x-ndjson", `{"path":"a.x","timestamp":0,"value":1}
+{"path":"a.y","timestamp":60,"value":2.5}
+{"path":"a.y","timestamp":120,"value":-3}
+`},
+		// Empty rows are left out
+		{"wide", "text/csv", "timestamp,a.x,a.y\n0,1,\n60,,2.5\n120,,-3\n"},
+	} {
+		var buf bytes.Buffer
+		w, err := NewWriter(tc.format, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range chunks {
+			if err := w.Write(c); err != nil {
+				t.Fatalf("%s: %s", tc.format, err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("%s: %s", tc.format, err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s wrote\n%s\nwant\n%s", tc.format, got, tc.want)
+		}
+		if w.ContentType() != tc.contentType {
+			t.Errorf("%s ContentType() = %s, want %s", tc.format, w.ContentType(), tc.contentType)
+		}
+	}
+
+	if _, err := NewWriter("xml", &bytes.Buffer{}); err == nil {
+		t.Error("NewWriter(xml) succeeded")
+	}
+}
+
+func TestWideBatches(t *testing.T) {
+	first := chunk([]string{"a.x"}, 0, []interface{}{1.0})
+	second := chunk([]string{"a.y"}, 0, []interface{}{2.0})
+	defer first.Release()
+	defer second.Release()
+
+	w, _ := NewWriter("wide", &bytes.Buffer{})
+	if err := w.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(second); err == nil {
+		t.Error("wide export of a second batch succeeded")
+	}
+}
@@ -12,6 +12,9 @@ import (
 	"sync"
 )
 
+// Most matches returned by a single search
+const QUERY_SIZE = 1000
+
 type ElasticSearchDriver struct {
 	conn    *elastigo.Conn
 	indexer *elastigo.BulkIndexer
@@ -73,6 +76,45 @@ func (d *ElasticSearchDriver) Update(path string) error {
 	return nil
 }
 
+func (d *ElasticSearchDriver) Delete(path string) ([]string, error) {
+	log.Println("index/elasticsearch: deleting path:", path)
+	d.mux.Lock()
+	delete(d.cache, path)
+	d.mux.Unlock()
+
+	// Make sure nothing is still queued up that would add it back,
+	// and that searching for children sees everything up to now
+	d.indexer.Flush()
+	if _, err := d.conn.Refresh(d.index); err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	if _, err := d.conn.Delete(d.index, "path", path, nil); err != nil {
+		return removed, err
+	}
+	removed = append(removed, path)
+
+	for end := strings.LastIndex(path, "."); end > -1; end = strings.LastIndex(path, ".") {
+		if _, err := d.conn.Refresh(d.index); err != nil {
+			return removed, err
+		}
+		path = path[0:end]
+		children, err := d.GetChildren(path)
+		if err != nil {
+			return removed, err
+		}
+		if len(children) > 0 {
+			break
+		}
+		if _, err := d.conn.Delete(d.index, "path", path, nil); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
 func (d *ElasticSearchDriver) GetChildren(path string) ([]*Path, error) {
 	var depth int
 	if path != "" {
@@ -107,6 +149,31 @@ func (d *ElasticSearchDriver) GetChildren(path string) ([]*Path, error) {
 }
 
 func (d *ElasticSearchDriver) Query(path string) ([]*Path, error) {
+	hits, err := d.search(path, 0, QUERY_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	return hitsToPaths(hits), nil
+}
+
+// QueryAll pages through every match, QUERY_SIZE at a time. Paging past
+// the index's max_result_window is an error from Elasticsearch, rather
+// than a partial result.
+func (d *ElasticSearchDriver) QueryAll(path string) ([]*Path, error) {
+	var paths []*Path
+	for {
+		hits, err := d.search(path, len(paths), QUERY_SIZE)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, hitsToPaths(hits)...)
+		if len(hits.Hits) == 0 || len(paths) >= hits.Total {
+			return paths, nil
+		}
+	}
+}
+
+func (d *ElasticSearchDriver) search(path string, from, size int) (elastigo.Hits, error) {
 	q := StringToQuery(path)
 	var where map[string]interface{}
 	if q.Method == REGEXP {
@@ -126,7 +193,8 @@ func (d *ElasticSearchDriver) Query(path string) ([]*Path, error) {
 		}
 	}
 	query := map[string]interface{}{
-		"size": 1000,
+		"from": from,
+		"size": size,
 		"query": map[string]interface{}{
 			"filtered": map[string]interface{}{
 				"query": where,
@@ -154,9 +222,9 @@ func (d *ElasticSearchDriver) Query(path string) ([]*Path, error) {
 	resp, err := d.conn.Search(d.index, "path", nil, query)
 	if err != nil {
 		log.Println("index/elasticsearch:", err)
-		return nil, err
+		return elastigo.Hits{}, err
 	}
-	return hitsToPaths(resp.Hits), nil
+	return resp.Hits, nil
 }
 
 func (d *ElasticSearchDriver) Close() {
@@ -14,6 +14,65 @@ func (s *Store) Update(path string) error {
 	return s.driver.Update(path)
 }
 
+// Delete removes a leaf from the index, along with any branches that
+// are left without children. Returns the keys that were removed.
+func (s *Store) Delete(path string) ([]string, error) {
+	return s.driver.Delete(path)
+}
+
+// WouldDelete returns the keys that deleting every one of paths would
+// remove, including branches left without children, without removing
+// anything. Branches are checked as they are now, so anything written in
+// the meantime can leave a branch that was reported in place.
+func (s *Store) WouldDelete(paths []string) ([]string, error) {
+	removed := make(map[string]bool, len(paths))
+	keys := make([]string, 0, len(paths))
+	// Branches above the paths, by depth
+	branches := make(map[int][]string)
+	deepest := -1
+	for _, path := range paths {
+		if removed[path] {
+			continue
+		}
+		removed[path] = true
+		keys = append(keys, path)
+		for end := strings.LastIndex(path, "."); end > -1; end = strings.LastIndex(path, ".") {
+			path = path[:end]
+			depth := strings.Count(path, ".")
+			branches[depth] = append(branches[depth], path)
+			if depth > deepest {
+				deepest = depth
+			}
+		}
+	}
+
+	// Deepest first, so a branch emptied by removing its
+	// children is seen as removed by its parent
+	for depth := deepest; depth >= 0; depth-- {
+		for _, branch := range branches[depth] {
+			if removed[branch] {
+				continue
+			}
+			children, err := s.driver.GetChildren(branch)
+			if err != nil {
+				return keys, err
+			}
+			empty := true
+			for _, child := range children {
+				if !removed[child.Key] {
+					empty = false
+				}
+				child.Release()
+			}
+			if empty {
+				removed[branch] = true
+				keys = append(keys, branch)
+			}
+		}
+	}
+	return keys, nil
+}
+
 func (s *Store) Ping() error {
 	return s.driver.Ping()
 }
@@ -22,10 +81,18 @@ func (s *Store) GetChildren(path string) ([]*Path, error) {
 	return s.driver.GetChildren(path)
 }
 
+// Query returns the leaves matching path, up to however many
+// the driver returns at once, which is plenty for rendering
 func (s *Store) Query(path string) ([]*Path, error) {
 	return s.driver.Query(path)
 }
 
+// QueryAll returns every leaf matching path, for when
+// missing some would be wrong, such as deleting them
+func (s *Store) QueryAll(path string) ([]*Path, error) {
+	return s.driver.QueryAll(path)
+}
+
 type Path struct {
 	Key   string
 	Depth int
@@ -66,8 +133,10 @@ func NewBranch(path string) *Path {
 type Driver interface {
 	Init(*url.URL) error
 	Update(string) error
+	Delete(string) ([]string, error)
 	GetChildren(string) ([]*Path, error)
 	Query(string) ([]*Path, error)
+	QueryAll(string) ([]*Path, error)
 	Ping() error
 	Close()
 }
@@ -16,6 +16,10 @@ func (d *MemoryDriver) Update(path string) error {
 	return nil
 }
 
+func (d *MemoryDriver) Delete(path string) ([]string, error) {
+	return nil, nil
+}
+
 func (d *MemoryDriver) GetChildren(path string) ([]*Path, error) {
 	return nil, nil
 }
@@ -24,6 +28,10 @@ func (d *MemoryDriver) Query(path string) ([]*Path, error) {
 	return nil, nil
 }
 
+func (d *MemoryDriver) QueryAll(path string) ([]*Path, error) {
+	return nil, nil
+}
+
 func (d *MemoryDriver) Close() {
 	return
 }
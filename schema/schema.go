@@ -4,6 +4,7 @@ import (
 	log "github.com/mattrobenolt/mineshaft/logging"
 	"github.com/vaughan0/go-ini"
 
+	"fmt"
 	"io"
 	"os"
 	"regexp"
@@ -16,12 +17,28 @@ type Bucket struct {
 	Ttl    time.Duration
 	Period int
 	Rollup time.Duration
+	// Size of the time window that is part of the partition key.
+	// Zero means the whole series lives in a single partition.
+	Window time.Duration
 }
 
 func (b *Bucket) RoundDown(t uint32) uint32 {
 	return (t / uint32(b.Rollup.Seconds())) * uint32(b.Rollup.Seconds())
 }
 
+// The start of the time window that t falls into
+func (b *Bucket) WindowStart(t uint32) uint32 {
+	if b.Window == 0 {
+		return 0
+	}
+	return (t / uint32(b.Window.Seconds())) * uint32(b.Window.Seconds())
+}
+
+// Range covers from-to with the slots of this bucket
+func (b *Bucket) Range(from, to int) *Range {
+	return newRange(b, from, to)
+}
+
 type Rule struct {
 	name    string
 	pattern *regexp.Regexp
@@ -33,6 +50,9 @@ func (r *Rule) String() string {
 	out += "@["
 	for _, b := range r.Buckets {
 		out += " " + b.Rollup.String() + ":" + b.Ttl.String()
+		if b.Window > 0 {
+			out += ":" + b.Window.String()
+		}
 	}
 	out += " ]"
 	return out
@@ -67,14 +87,19 @@ func (s *Schema) Match(path string) *Rule {
 	return s.defaultRule
 }
 
-func (s *Schema) GetRange(path string, from, to int) *Range {
+// GetRange picks the finest bucket that, as of now, still
+// retains everything back to from. With maxDataPoints above zero,
+// buckets that would return more points than that are skipped too.
+func (s *Schema) GetRange(path string, from, to, now, maxDataPoints int) *Range {
 	buckets := s.Match(path).Buckets
 	log.Println(buckets)
-	duration := to - from
 	var bucket *Bucket
 	for _, b := range buckets {
-		if int(b.Ttl.Seconds()) > duration {
-			bucket = b
+		if now-int(b.Ttl.Seconds()) > from {
+			continue
+		}
+		bucket = b
+		if maxDataPoints == 0 || (to-from)/int(b.Rollup.Seconds()) <= maxDataPoints {
 			break
 		}
 	}
@@ -83,6 +108,46 @@ func (s *Schema) GetRange(path string, from, to int) *Range {
 		bucket = buckets[len(buckets)-1]
 	}
 	log.Println("schema:", bucket)
+	return newRange(bucket, from, to)
+}
+
+// GetRangeAtResolution reads from the bucket with the given rollup,
+// regardless of whether it still retains the whole range.
+func (s *Schema) GetRangeAtResolution(path string, from, to int, rollup time.Duration) (*Range, error) {
+	for _, b := range s.Match(path).Buckets {
+		if b.Rollup == rollup {
+			return newRange(b, from, to), nil
+		}
+	}
+	return nil, fmt.Errorf("schema: %s has no %s bucket", path, rollup)
+}
+
+// GetRanges splits from-to into one Range per bucket, so each part
+// comes from the finest bucket that still retains it as of now.
+// Ranges are ordered from the finest, most recent, to the coarsest.
+func (s *Schema) GetRanges(path string, from, to, now int) []*Range {
+	var ranges []*Range
+	buckets := s.Match(path).Buckets
+	upper := to
+	for i, b := range buckets {
+		lower := now - int(b.Ttl.Seconds())
+		if i == len(buckets)-1 || lower < from {
+			// Anything older than the last bucket is gone regardless
+			lower = from
+		}
+		if lower >= upper {
+			continue
+		}
+		ranges = append(ranges, newRange(b, lower, upper))
+		upper = lower
+		if upper <= from {
+			break
+		}
+	}
+	return ranges
+}
+
+func newRange(bucket *Bucket, from, to int) *Range {
 	rollup := int(bucket.Rollup.Seconds())
 	return &Range{
 		Start:  uint32(from),
@@ -90,7 +155,8 @@ func (s *Schema) GetRange(path string, from, to int) *Range {
 		Lower:  roundDown(from, rollup),
 		Upper:  roundUp(to, rollup),
 		Period: bucket.Period,
-		Rollup: int(bucket.Rollup.Seconds()),
+		Rollup: rollup,
+		Window: int(bucket.Window.Seconds()),
 	}
 }
 
@@ -132,30 +198,50 @@ func LoadFile(path string) *Schema {
 
 var defaultSchema = &Schema{}
 
+// Parses retentions in the form of rollup:ttl[:window], e.g.
+// 20s:2d:1d,10min:1y:4w
 func parseTimeBuckets(buckets string) (bs []*Bucket) {
 	for _, b := range strings.Split(buckets, ",") {
-		pieces := strings.SplitN(b, ":", 2)[0:2]
+		pieces := strings.SplitN(b, ":", 3)
 		rollup, ttl := toTime(pieces[0]), toTime(pieces[1])
 		bucket := &Bucket{
 			Ttl:    ttl,
 			Period: int(ttl / rollup),
 			Rollup: rollup,
 		}
+		if len(pieces) == 3 {
+			bucket.Window = toTime(pieces[2])
+			if bucket.Window%rollup != 0 {
+				log.Fatal("schema: window ", pieces[2], " is not a multiple of rollup ", pieces[0])
+			}
+		}
 		bs = append(bs, bucket)
 	}
 	return
 }
 
 func toTime(s string) time.Duration {
-	re := regexp.MustCompile(`^(\d+)(s|m|min|h|d|w|y)$`)
-	pieces := re.FindAllStringSubmatch(s, -1)[0][1:]
-	quantity, _ := strconv.Atoi(pieces[0])
+	d, err := ParseTime(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+var timePattern = regexp.MustCompile(`^(\d+)(s|m|min|h|d|w|y)$`)
+
+// ParseTime parses a duration as written in retentions, e.g. 20s or 1min
+func ParseTime(s string) (time.Duration, error) {
+	matches := timePattern.FindStringSubmatch(s)
+	if matches == nil {
+		return 0, fmt.Errorf("schema: invalid time %q", s)
+	}
+	quantity, _ := strconv.Atoi(matches[1])
 	var unit time.Duration
-	switch pieces[1] {
+	switch matches[2] {
 	case "s":
 		unit = time.Second
-	case "m":
-	case "min":
+	case "m", "min":
 		unit = time.Minute
 	case "h":
 		unit = time.Hour
@@ -166,13 +252,39 @@ func toTime(s string) time.Duration {
 	case "y":
 		unit = 365 * 24 * time.Hour
 	}
-	return time.Duration(quantity) * unit
+	return time.Duration(quantity) * unit, nil
 }
 
 type Range struct {
 	Start, End     uint32
 	Lower, Upper   int
 	Period, Rollup int
+	// Size of the partition time window in seconds, or zero
+	Window int
+}
+
+// The start of every time window the Range spans
+func (r *Range) Windows() []int {
+	if r.Window == 0 {
+		return nil
+	}
+	var windows []int
+	for w := roundDown(r.Lower, r.Window); w <= r.Upper; w += r.Window {
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+// NewRange covers from-to in steps of rollup seconds,
+// without being tied to any Bucket
+func NewRange(from, to, rollup int) *Range {
+	return &Range{
+		Start:  uint32(from),
+		End:    uint32(to),
+		Lower:  roundDown(from, rollup),
+		Upper:  roundUp(to, rollup),
+		Rollup: rollup,
+	}
 }
 
 func (r *Range) Duration() int {
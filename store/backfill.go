@@ -0,0 +1,125 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	log "github.com/mattrobenolt/mineshaft/logging"
+	"github.com/mattrobenolt/mineshaft/metric"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"fmt"
+)
+
+// Drivers that can overwrite slots, rather than adding to them, so
+// that historical data can be backfilled more than once
+type backfiller interface {
+	// Replace slots of a bucket, keyed by the start of each slot
+	SetBucket(string, map[uint32]*accumulator, *aggregate.Rule, *schema.Bucket) error
+}
+
+type BackfillResult struct {
+	Points int
+	Series int
+	// Slots written, across every bucket and method
+	Slots int
+}
+
+// Backfill writes historical points, setting every slot they fall in
+// rather than adding to it, so the same data can be replayed without
+// counting it twice. The value of each slot, in every bucket, is computed
+// from the points given, so all points of a slot, including for the
+// coarsest bucket, need to be in the same call, or the slot only ends up
+// with the ones that were.
+//
+// Backfilling is offline only: nothing else may write to the series while
+// it runs. Drivers set counters by reading them and adding the difference,
+// and overwrite MIN, MAX and FIRST without comparing against what's there,
+// so live writes to the same slots are lost or counted twice.
+//
+// With downsampling, coarser slots that haven't been rolled up yet are
+// left for the rollup to derive from the finest bucket.
+func (s *Store) Backfill(points metric.Points) (*BackfillResult, error) {
+	driver, ok := s.driver.(backfiller)
+	if !ok {
+		return nil, fmt.Errorf("store: %T can't backfill", s.driver)
+	}
+	series := make(map[string]metric.Points)
+	for _, p := range points {
+		series[p.GetPath()] = append(series[p.GetPath()], p)
+	}
+	result := &BackfillResult{Points: len(points)}
+	for path, points := range series {
+		if err := s.index.Update(path); err != nil {
+			return result, err
+		}
+		n, err := s.backfill(driver, path, points)
+		result.Slots += n
+		if err != nil {
+			return result, err
+		}
+		result.Series++
+	}
+	log.Println("store: backfilled", result.Points, "points into", result.Slots, "slots of", result.Series, "series")
+	return result, nil
+}
+
+func (s *Store) backfill(driver backfiller, path string, points metric.Points) (int, error) {
+	buckets, agg := s.GetBuckets(path), s.aggregation.Match(path)
+	var newest uint32
+	for _, p := range points {
+		if p.GetTimestamp() > newest {
+			newest = p.GetTimestamp()
+		}
+	}
+
+	written := 0
+	for _, method := range agg.Methods {
+		rule := agg.For(method)
+		stored := storagePath(path, rule)
+		for i, b := range buckets {
+			var mark uint32
+			rolledUp := s.rollup != nil && i > 0 && downsampled(method)
+			if rolledUp {
+				mark = s.rollup.Mark(path, method, b)
+			}
+			slots := make(map[uint32]*accumulator)
+			lower, upper := -1, 0
+			for _, p := range points {
+				slot := b.RoundDown(p.GetTimestamp())
+				if rolledUp && slot >= mark {
+					continue
+				}
+				acc, ok := slots[slot]
+				if !ok {
+					acc = &accumulator{}
+					slots[slot] = acc
+				}
+				acc.Add(p.GetValue(), method)
+				if lower < 0 || int(slot) < lower {
+					lower = int(slot)
+				}
+				if int(slot) >= upper {
+					upper = int(slot) + int(b.Rollup.Seconds())
+				}
+			}
+			if len(slots) == 0 {
+				continue
+			}
+			if err := driver.SetBucket(stored, slots, rule, b); err != nil {
+				return written, err
+			}
+			written += len(slots)
+			if s.cache != nil {
+				s.cache.forget(stored, b.Range(lower, upper))
+			}
+		}
+	}
+
+	if s.rollup != nil && len(buckets) > 1 {
+		s.rollup.Track(path, newest, buckets, agg)
+	}
+	if s.hot != nil {
+		// What's held no longer matches what's stored, so start over
+		s.hot.Remove(path)
+	}
+	return written, nil
+}
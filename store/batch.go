@@ -0,0 +1,184 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	log "github.com/mattrobenolt/mineshaft/logging"
+	"github.com/mattrobenolt/mineshaft/metric"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"sync"
+	"time"
+)
+
+// Maximum number of partitions being flushed at once
+const MAX_INFLIGHT_BATCHES = 10
+
+// A partition is a single bucket of a single path, which
+// maps directly onto a (period, rollup, path) row in Cassandra
+type partition struct {
+	path   string
+	bucket *schema.Bucket
+}
+
+type pendingBatch struct {
+	agg    *aggregate.Rule
+	points metric.Points
+}
+
+// batcher collects points per partition and hands them to the
+// Driver in groups once either size points have been collected,
+// or interval has passed.
+type batcher struct {
+	// Looked up on every flush, so a new Driver is picked up
+	driver   func() Driver
+	size     int
+	interval time.Duration
+	// Told about every point the Driver fails to write
+	report func(*WriteError)
+
+	pending map[partition]*pendingBatch
+	mux     sync.Mutex
+	sem     chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newBatcher(driver func() Driver, size int, interval time.Duration, report func(*WriteError)) *batcher {
+	b := &batcher{
+		driver:   driver,
+		size:     size,
+		interval: interval,
+		report:   report,
+		pending:  make(map[partition]*pendingBatch),
+		sem:      make(chan struct{}, MAX_INFLIGHT_BATCHES),
+		done:     make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.run()
+	return b
+}
+
+// Add queues p to be written under path, which may differ
+// from its own path when it's one of several methods.
+func (b *batcher) Add(path string, p *metric.Point, agg *aggregate.Rule, bucket *schema.Bucket) {
+	// The caller releases their Point back to the pool
+	// once Set returns, so we need to hang onto our own copy.
+	cp := metric.New()
+	cp.SetPath(path)
+	cp.SetValue(p.GetValue())
+	cp.SetTimestamp(p.GetTimestamp())
+
+	key := partition{path, bucket}
+	b.mux.Lock()
+	batch, ok := b.pending[key]
+	if !ok {
+		batch = &pendingBatch{agg: agg, points: make(metric.Points, 0, b.size)}
+		b.pending[key] = batch
+	}
+	batch.points = append(batch.points, cp)
+	if len(batch.points) < b.size {
+		b.mux.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	b.mux.Unlock()
+	b.flush(key, batch)
+}
+
+func (b *batcher) run() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flushAll()
+		case <-b.done:
+			b.flushAll()
+			return
+		}
+	}
+}
+
+func (b *batcher) flushAll() {
+	b.mux.Lock()
+	pending := b.pending
+	b.pending = make(map[partition]*pendingBatch)
+	b.mux.Unlock()
+
+	var wg sync.WaitGroup
+	for key, batch := range pending {
+		wg.Add(1)
+		b.sem <- struct{}{}
+		go func(key partition, batch *pendingBatch) {
+			b.flush(key, batch)
+			<-b.sem
+			wg.Done()
+		}(key, batch)
+	}
+	wg.Wait()
+}
+
+func (b *batcher) flush(key partition, batch *pendingBatch) {
+	defer batch.points.Release()
+	errs := b.driver().WriteBatchToBucket(key.path, batch.points, batch.agg, key.bucket)
+	for i, err := range errs {
+		if err != nil {
+			log.Println("store/batch:", batch.points[i], batch.agg, key.bucket, err)
+			b.report(newWriteError(batch.points[i], err))
+		}
+	}
+}
+
+// Close flushes everything that is still pending
+func (b *batcher) Close() {
+	close(b.done)
+	b.wg.Wait()
+}
+
+// A WriteError is a point the Driver failed to write, with
+// the path it was to be stored under
+type WriteError struct {
+	Path      string
+	Timestamp uint32
+	Value     float64
+	Err       error
+}
+
+// WriteStats counts the points the Driver failed to write, and
+// how many of those couldn't be sent on because nobody kept up
+type WriteStats struct {
+	Failed, Dropped int64
+}
+
+// writeErrors hands points that failed to write to whoever is
+// listening, without ever holding up the writes themselves
+type writeErrors struct {
+	ch              chan<- *WriteError
+	failed, dropped int64
+	mux             sync.Mutex
+}
+
+func newWriteError(p *metric.Point, err error) *WriteError {
+	return &WriteError{p.GetPath(), p.GetTimestamp(), p.GetValue(), err}
+}
+
+func (w *writeErrors) Report(e *WriteError) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.failed++
+	if w.ch == nil {
+		return
+	}
+	select {
+	case w.ch <- e:
+	default:
+		w.dropped++
+	}
+}
+
+func (w *writeErrors) Stats() WriteStats {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return WriteStats{w.failed, w.dropped}
+}
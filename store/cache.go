@@ -0,0 +1,221 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many slots of a bucket are cached together as one block
+const CACHE_BLOCK_POINTS = 120
+
+// CacheBackend stores encoded blocks. It only deals in bytes, so that
+// something like memcached can be shared between multiple api nodes.
+type CacheBackend interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+}
+
+// Cache holds reads from the Driver in blocks aligned to
+// CACHE_BLOCK_POINTS slots of a bucket. Only blocks whose slots
+// have all closed are cached, the block still being written to
+// is always read from the Driver.
+type Cache struct {
+	backend CacheBackend
+	ttl     time.Duration
+
+	hits, misses int64
+}
+
+type CacheStats struct {
+	Hits, Misses int64
+	// Only reported by backends that know
+	Entries int
+	Bytes   int64
+}
+
+func NewCache(backend CacheBackend, ttl time.Duration) *Cache {
+	return &Cache{backend: backend, ttl: ttl}
+}
+
+func (c *Cache) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+	}
+	if m, ok := c.backend.(*MemoryCache); ok {
+		stats.Entries, stats.Bytes = m.Size()
+	}
+	return stats
+}
+
+func blockKey(path string, r *schema.Range, start int) string {
+	return fmt.Sprintf("%s:%d:%d:%d", path, r.Period, r.Rollup, start)
+}
+
+// A block is closed once its last slot has ended, with one
+// more rollup of grace for points that arrive late
+func blockClosed(r *schema.Range, end, now int) bool {
+	return end+r.Rollup <= now
+}
+
+// lookup returns as much of the start of r as is cached, and where the
+// rest of it, that still needs to be read, starts.
+func (c *Cache) lookup(path string, r *schema.Range, now int) (NullFloat64s, int) {
+	span := CACHE_BLOCK_POINTS * r.Rollup
+	prefix := make(NullFloat64s, 0, r.Len())
+	cursor := r.Lower
+	for cursor < r.Upper {
+		start := cursor / span * span
+		end := start + span
+		if !blockClosed(r, end, now) {
+			break
+		}
+		value, ok := c.backend.Get(blockKey(path, r, start))
+		if !ok {
+			atomic.AddInt64(&c.misses, 1)
+			break
+		}
+		atomic.AddInt64(&c.hits, 1)
+		if end > r.Upper {
+			end = r.Upper
+		}
+		for t := cursor; t < end; t += r.Rollup {
+			prefix = append(prefix, decodeSlot(value, (t-start)/r.Rollup))
+		}
+		cursor = end
+	}
+	return prefix, cursor
+}
+
+// fill caches every closed block that data, read over r, fully covers.
+// Drivers never fill the very last slot of a range, so a block
+// ending right at r.Upper isn't complete either.
+func (c *Cache) fill(path string, r *schema.Range, data NullFloat64s, now int) {
+	span := CACHE_BLOCK_POINTS * r.Rollup
+	for start := (r.Lower + span - 1) / span * span; start+span < r.Upper; start += span {
+		if !blockClosed(r, start+span, now) {
+			return
+		}
+		offset := (start - r.Lower) / r.Rollup
+		if offset+CACHE_BLOCK_POINTS > len(data) {
+			return
+		}
+		c.backend.Set(blockKey(path, r, start), encodeBlock(data[offset:offset+CACHE_BLOCK_POINTS]), c.ttl)
+	}
+}
+
+// forget drops every cached block of path overlapping r,
+// for when slots that were already closed are written again
+func (c *Cache) forget(path string, r *schema.Range) {
+	span := CACHE_BLOCK_POINTS * r.Rollup
+	for start := r.Lower / span * span; start < r.Upper; start += span {
+		c.backend.Delete(blockKey(path, r, start))
+	}
+}
+
+// Each slot is a byte for whether it's valid, followed by the value
+const slotSize = 9
+
+func encodeBlock(data NullFloat64s) []byte {
+	buf := make([]byte, len(data)*slotSize)
+	for i, v := range data {
+		if v == nil || !v.Valid {
+			continue
+		}
+		buf[i*slotSize] = 1
+		binary.BigEndian.PutUint64(buf[i*slotSize+1:], math.Float64bits(v.Float64))
+	}
+	return buf
+}
+
+func decodeSlot(buf []byte, i int) *NullFloat64 {
+	if (i+1)*slotSize > len(buf) || buf[i*slotSize] == 0 {
+		return nil
+	}
+	return NewNullFloat64(math.Float64frombits(binary.BigEndian.Uint64(buf[i*slotSize+1:])), true)
+}
+
+// MemoryCache is an in process CacheBackend, evicting the least
+// recently used blocks once it holds more than MaxBytes.
+type MemoryCache struct {
+	MaxBytes int64
+
+	bytes int64
+	ll    *list.List
+	cache map[string]*list.Element
+	mux   sync.Mutex
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		MaxBytes: maxBytes,
+		ll:       list.New(),
+		cache:    make(map[string]*list.Element),
+	}
+}
+
+func (m *MemoryCache) Get(key string) ([]byte, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	ele, ok := m.cache[key]
+	if !ok {
+		return nil, false
+	}
+	entry := ele.Value.(*memoryEntry)
+	if time.Now().After(entry.expires) {
+		m.removeElement(ele)
+		return nil, false
+	}
+	m.ll.MoveToFront(ele)
+	return entry.value, true
+}
+
+func (m *MemoryCache) Set(key string, value []byte, ttl time.Duration) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if ele, ok := m.cache[key]; ok {
+		m.removeElement(ele)
+	}
+	entry := &memoryEntry{key, value, time.Now().Add(ttl)}
+	m.cache[key] = m.ll.PushFront(entry)
+	m.bytes += int64(len(key) + len(value))
+	for m.bytes > m.MaxBytes && m.ll.Len() > 0 {
+		m.removeElement(m.ll.Back())
+	}
+}
+
+func (m *MemoryCache) Delete(key string) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if ele, ok := m.cache[key]; ok {
+		m.removeElement(ele)
+	}
+}
+
+// Size returns how many entries, and bytes, are held
+func (m *MemoryCache) Size() (int, int64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.ll.Len(), m.bytes
+}
+
+func (m *MemoryCache) removeElement(ele *list.Element) {
+	entry := ele.Value.(*memoryEntry)
+	m.ll.Remove(ele)
+	delete(m.cache, entry.key)
+	m.bytes -= int64(len(entry.key) + len(entry.value))
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"github.com/gocql/gocql"
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"fmt"
+	"time"
+)
+
+// SetBucket overwrites slots of a bucket with the aggregates given,
+// keyed by the start of each slot. Counters can't be set, so each one
+// is read first and the difference added to it, which means the slots
+// mustn't be written by anything else while they're being backfilled.
+// MIN, MAX and FIRST are overwritten with a plain write, rather than
+// the lightweight transactions that compare against what's stored, so
+// a live write racing it can be lost either way. Each slot expires as
+// if it had been written at the time it covers, and slots that have
+// already outlived the bucket's retention are skipped.
+func (d *CassandraDriver) SetBucket(path string, slots map[uint32]*accumulator, agg *aggregate.Rule, b *schema.Bucket) error {
+	if d.chunks != nil {
+		return d.chunks.Set(path, slots, agg, b)
+	}
+	ttl := int(b.Ttl.Seconds())
+	now := int(time.Now().Unix())
+	stmts := statementsFor(b.Window > 0)
+	for time, acc := range slots {
+		age := ttl - (now - int(time))
+		if age <= 0 {
+			continue
+		}
+		if age > ttl {
+			// Ahead of the clock, which a live write keeps for ttl
+			age = ttl
+		}
+		key := partitionKey(path, b.Period, int(b.Rollup.Seconds()), int(b.WindowStart(time)))
+		key = append(key, time)
+		var err error
+		switch agg.Method {
+		case aggregate.LAST:
+			err = d.session.Query(stmts.lastUpdate, append([]interface{}{age, acc.last}, key...)...).Exec()
+		case aggregate.MIN, aggregate.MAX, aggregate.FIRST:
+			stmt := stmts.minmaxSet
+			if agg.Method == aggregate.FIRST {
+				stmt = stmts.firstSet
+			}
+			value := acc.Value(agg.Method)
+			if err = d.session.Query(stmt, append([]interface{}{age, value}, key...)...).Exec(); err == nil {
+				d.extremes.Set(fmt.Sprintf("%v", key), value)
+			}
+		default:
+			if err = d.setCounter(stmts, key, acc, agg); err == nil {
+				d.track(path, time, agg, b)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setCounter reads the counters of a slot, identified by key, and adds
+// whatever it takes for them to match acc
+func (d *CassandraDriver) setCounter(stmts *statements, key []interface{}, acc *accumulator, agg *aggregate.Rule) error {
+	// Selects take a range of slots, so ask for just this one
+	time := key[len(key)-1]
+	args := append(append([]interface{}{}, key...), time)
+
+	var data, count, t int64
+	switch agg.Method {
+	case aggregate.SUM:
+		if err := d.scanSlot(stmts.sumSelect, args, &data, &t); err != nil {
+			return err
+		}
+		return d.addCounter(stmts.sumUpdate, key, toInt64(acc.sum)-data)
+	case aggregate.AVG:
+		if err := d.scanSlot(stmts.avgSelect, args, &data, &count, &t); err != nil {
+			return err
+		}
+		delta := toInt64(acc.sum) - data
+		if n := int64(acc.count) - count; delta != 0 || n != 0 {
+			return d.session.Query(stmts.avgMerge, append([]interface{}{delta, n}, key...)...).Exec()
+		}
+		return nil
+	case aggregate.COUNT:
+		if err := d.scanSlot(stmts.countSelect, args, &count, &t); err != nil {
+			return err
+		}
+		return d.addCounter(stmts.countMerge, key, int64(acc.count)-count)
+	}
+	if _, ok := agg.Method.Quantile(); !ok {
+		return fmt.Errorf("store/cassandra: can't set %v", agg.Method)
+	}
+
+	// Bins no longer in the sketch are counted down to zero
+	deltas := make(map[int32]int64)
+	if acc.sketch != nil {
+		for bin, n := range acc.sketch.bins {
+			deltas[bin] = int64(n)
+		}
+	}
+	var bin int
+	iter := d.session.Query(stmts.sketchSelect, args...).Consistency(d.readConsistency).Iter()
+	for iter.Scan(&bin, &count, &t) {
+		deltas[int32(bin)] -= count
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	for bin, delta := range deltas {
+		if delta == 0 {
+			continue
+		}
+		stmtArgs := append(append([]interface{}{delta}, key...), int(bin))
+		if err := d.session.Query(stmts.sketchMerge, stmtArgs...).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanSlot reads a single slot, leaving dest as is when it's empty
+func (d *CassandraDriver) scanSlot(stmt string, args []interface{}, dest ...interface{}) error {
+	err := d.session.Query(stmt, args...).Consistency(d.readConsistency).Scan(dest...)
+	if err == gocql.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (d *CassandraDriver) addCounter(stmt string, key []interface{}, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	return d.session.Query(stmt, append([]interface{}{delta}, key...)...).Exec()
+}
+
+const MINMAX_SET = `
+UPDATE minmax USING TTL ?
+SET data = ?
+WHERE rollup = ? AND period = ? AND path = ? AND time = ?
+`
+
+const FIRST_SET = `
+UPDATE first USING TTL ?
+SET data = ?
+WHERE rollup = ? AND period = ? AND path = ? AND time = ?
+`
+
+const MINMAX_WINDOWED_SET = `
+UPDATE minmax_windowed USING TTL ?
+SET data = ?
+WHERE rollup = ? AND period = ? AND path = ? AND window_start = ? AND time = ?
+`
+
+const FIRST_WINDOWED_SET = `
+UPDATE first_windowed USING TTL ?
+SET data = ?
+WHERE rollup = ? AND period = ? AND path = ? AND window_start = ? AND time = ?
+`
@@ -0,0 +1,465 @@
+package store
+
+import (
+	"github.com/gocql/gocql"
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	log "github.com/mattrobenolt/mineshaft/logging"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How many slots of a bucket go into a single chunk
+const CHUNK_POINTS = 120
+
+// How often chunks are checked for having closed
+const CHUNK_FLUSH_INTERVAL = 10 * time.Second
+
+// How long points are held in memory at most before being written,
+// even though the chunk they're in is still open
+const CHUNK_MAX_AGE = time.Minute
+
+// With layout=chunks, a series is stored as one row per CHUNK_POINTS
+// slots of a bucket, with the slots Gorilla encoded. Points are
+// aggregated into the chunk in memory, and the chunk is written once
+// its last slot has ended, or once it has held points for CHUNK_MAX_AGE,
+// so that a restart loses no more than that and other processes can read
+// them. Points that arrive for a chunk that was already written are
+// merged into it when it's written again.
+//
+// Chunks are read, merged and written back without any coordination,
+// so each series must only be written by a single process.
+type chunkStore struct {
+	session         *gocql.Session
+	readConsistency gocql.Consistency
+
+	open map[chunkKey]*openChunk
+	// Told about every slot of a chunk that fails to be written
+	report func(*WriteError)
+	mux    sync.Mutex
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+type chunkKey struct {
+	path           string
+	rollup, period int
+	start          uint32
+}
+
+type openChunk struct {
+	bucket *schema.Bucket
+	agg    *aggregate.Rule
+	slots  map[uint32]*accumulator
+	// When the first point not yet written was added
+	opened time.Time
+}
+
+func newChunkStore(session *gocql.Session, readConsistency gocql.Consistency) *chunkStore {
+	c := &chunkStore{
+		session:         session,
+		readConsistency: readConsistency,
+		open:            make(map[chunkKey]*openChunk),
+		done:            make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+func newOpenChunk(b *schema.Bucket, agg *aggregate.Rule) *openChunk {
+	return &openChunk{b, agg, make(map[uint32]*accumulator), time.Now()}
+}
+
+func chunkSpan(rollup int) int {
+	return CHUNK_POINTS * rollup
+}
+
+func (c *chunkStore) Add(path string, time uint32, value float64, agg *aggregate.Rule, b *schema.Bucket) {
+	rollup := int(b.Rollup.Seconds())
+	slot := b.RoundDown(time)
+	span := uint32(chunkSpan(rollup))
+	key := chunkKey{path, rollup, b.Period, slot / span * span}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	chunk, ok := c.open[key]
+	if !ok {
+		chunk = newOpenChunk(b, agg)
+		c.open[key] = chunk
+	}
+	acc, ok := chunk.slots[slot]
+	if !ok {
+		acc = &accumulator{}
+		chunk.slots[slot] = acc
+	}
+	acc.Add(value, agg.Method)
+}
+
+func (c *chunkStore) run() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(CHUNK_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flush(false)
+		case <-c.done:
+			c.flush(true)
+			return
+		}
+	}
+}
+
+// flush writes every chunk that has closed or held points for too long,
+// or every chunk when all is set. Chunks that fail to be written are
+// reported, and kept around to try again.
+func (c *chunkStore) flush(all bool) {
+	start := time.Now()
+	now := uint32(start.Unix())
+	closed := make(map[chunkKey]*openChunk)
+	c.mux.Lock()
+	report := c.report
+	for key, chunk := range c.open {
+		end := key.start + uint32(chunkSpan(key.rollup)+key.rollup)
+		if all || end <= now || start.Sub(chunk.opened) >= CHUNK_MAX_AGE {
+			closed[key] = chunk
+			delete(c.open, key)
+		}
+	}
+	c.mux.Unlock()
+
+	for key, chunk := range closed {
+		if err := c.write(key, chunk); err != nil {
+			log.Println("store/chunks:", key.path, key.start, err)
+			if report != nil {
+				for t, acc := range chunk.slots {
+					report(&WriteError{key.path, t, storedValue(acc, chunk.agg.Method), err})
+				}
+			}
+			if !all {
+				c.putBack(key, chunk)
+			}
+		}
+	}
+}
+
+func (c *chunkStore) putBack(key chunkKey, chunk *openChunk) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if newer, ok := c.open[key]; ok {
+		mergeSlots(chunk.slots, newer.slots)
+		if newer.opened.Before(chunk.opened) {
+			chunk.opened = newer.opened
+		}
+	}
+	c.open[key] = chunk
+}
+
+func (c *chunkStore) ReportWriteErrors(report func(*WriteError)) {
+	c.mux.Lock()
+	c.report = report
+	c.mux.Unlock()
+}
+
+// write merges chunk into whatever was already written for it
+func (c *chunkStore) write(key chunkKey, chunk *openChunk) error {
+	stored, err := c.read(key)
+	if err != nil {
+		return err
+	}
+	mergeSlots(stored, chunk.slots)
+	return c.put(key, chunk.bucket, chunk.agg, stored)
+}
+
+// put writes a chunk made up of slots, replacing what was there
+func (c *chunkStore) put(key chunkKey, b *schema.Bucket, agg *aggregate.Rule, stored map[uint32]*accumulator) error {
+	times := make([]int, 0, len(stored))
+	for t := range stored {
+		times = append(times, int(t))
+	}
+	sort.Ints(times)
+	values := make([]chunkPoint, len(times))
+	counts := make([]chunkPoint, len(times))
+	var sketches []byte
+	_, percentile := agg.Method.Quantile()
+	for i, t := range times {
+		acc := stored[uint32(t)]
+		values[i] = chunkPoint{uint32(t), storedValue(acc, agg.Method)}
+		counts[i] = chunkPoint{uint32(t), float64(acc.count)}
+		if percentile {
+			sketches = appendSketch(sketches, acc.sketch)
+		}
+	}
+
+	// Expire along with the last slot of the chunk
+	end := int64(key.start) + int64(chunkSpan(key.rollup))
+	ttl := end + int64(b.Ttl.Seconds()) - time.Now().Unix()
+	if ttl <= 0 {
+		return nil
+	}
+	return c.session.Query(
+		CHUNK_INSERT,
+		key.rollup, key.period, key.path, int64(key.start), encodeChunk(values), encodeChunk(counts), sketches, ttl,
+	).Exec()
+}
+
+// read returns the slots already written for a chunk
+func (c *chunkStore) read(key chunkKey) (map[uint32]*accumulator, error) {
+	slots := make(map[uint32]*accumulator)
+	var data, counts, sketches []byte
+	err := c.session.Query(
+		CHUNK_SELECT_ONE,
+		key.rollup, key.period, key.path, int64(key.start),
+	).Consistency(c.readConsistency).Scan(&data, &counts, &sketches)
+	if err == gocql.ErrNotFound {
+		return slots, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return slots, decodeSlots(slots, data, counts, sketches)
+}
+
+func decodeSlots(slots map[uint32]*accumulator, data, counts, sketches []byte) error {
+	values, err := decodeChunk(data)
+	if err != nil {
+		return err
+	}
+	ns, err := decodeChunk(counts)
+	if err != nil {
+		return err
+	}
+	if len(ns) != len(values) {
+		return errChunkCorrupt
+	}
+	for i, p := range values {
+		acc := storedAccumulator(p.value, int(ns[i].value))
+		if len(sketches) > 0 {
+			if acc.sketch, sketches, err = readSketch(sketches); err != nil {
+				return err
+			}
+		}
+		if existing, ok := slots[p.time]; ok {
+			existing.Merge(acc)
+		} else {
+			slots[p.time] = &acc
+		}
+	}
+	return nil
+}
+
+// Get reads every chunk overlapping r, along with what's still in memory
+func (c *chunkStore) Get(path string, r *schema.Range, agg *aggregate.Rule) (NullFloat64s, error) {
+	n := r.Len()
+	series := make(NullFloat64s, n)
+	span := chunkSpan(r.Rollup)
+	lower := r.Lower / span * span
+
+	slots := make(map[uint32]*accumulator)
+	var data, counts, sketches []byte
+	var err error
+	iter := c.session.Query(
+		CHUNK_SELECT,
+		r.Rollup, r.Period, path, lower, r.Upper,
+	).Consistency(c.readConsistency).Iter()
+	for iter.Scan(&data, &counts, &sketches) {
+		if err = decodeSlots(slots, data, counts, sketches); err != nil {
+			break
+		}
+	}
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+
+	c.mux.Lock()
+	for start := lower; start < r.Upper; start += span {
+		if chunk, ok := c.open[chunkKey{path, r.Rollup, r.Period, uint32(start)}]; ok {
+			mergeSlots(slots, chunk.slots)
+		}
+	}
+	c.mux.Unlock()
+
+	for t, acc := range slots {
+		if i := r.Index(int64(t)); i >= 0 && i < n && acc.count > 0 {
+			series[i] = NewNullFloat64(acc.Value(agg.Method), true)
+		}
+	}
+	return series, err
+}
+
+// Set replaces slots of path in bucket with the ones given, leaving
+// the other slots of their chunks as they were
+func (c *chunkStore) Set(path string, slots map[uint32]*accumulator, agg *aggregate.Rule, b *schema.Bucket) error {
+	rollup := int(b.Rollup.Seconds())
+	span := uint32(chunkSpan(rollup))
+	chunks := make(map[chunkKey]map[uint32]*accumulator)
+	for t, acc := range slots {
+		key := chunkKey{path, rollup, b.Period, t / span * span}
+		if chunks[key] == nil {
+			chunks[key] = make(map[uint32]*accumulator)
+		}
+		chunks[key][t] = acc
+	}
+	for key, replaced := range chunks {
+		c.mux.Lock()
+		if chunk, ok := c.open[key]; ok {
+			for t := range replaced {
+				delete(chunk.slots, t)
+			}
+		}
+		c.mux.Unlock()
+
+		stored, err := c.read(key)
+		if err != nil {
+			return err
+		}
+		for t, acc := range replaced {
+			stored[t] = acc
+		}
+		if err = c.put(key, b, agg, stored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete drops every chunk of path in bucket, including ones not yet written
+func (c *chunkStore) Delete(path string, b *schema.Bucket) error {
+	rollup := int(b.Rollup.Seconds())
+	c.mux.Lock()
+	for key := range c.open {
+		if key.path == path && key.rollup == rollup && key.period == b.Period {
+			delete(c.open, key)
+		}
+	}
+	c.mux.Unlock()
+	return c.session.Query(CHUNK_DELETE, rollup, b.Period, path).Exec()
+}
+
+// Copy merges every chunk of from into to
+func (c *chunkStore) Copy(from, to string, agg *aggregate.Rule, b *schema.Bucket) error {
+	rollup := int(b.Rollup.Seconds())
+	var (
+		start                  int64
+		data, counts, sketches []byte
+		err, writeErr          error
+	)
+	iter := c.session.Query(
+		CHUNK_SELECT_ALL,
+		rollup, b.Period, from,
+	).Consistency(c.readConsistency).Iter()
+	for writeErr == nil && iter.Scan(&start, &data, &counts, &sketches) {
+		chunk := newOpenChunk(b, agg)
+		if writeErr = decodeSlots(chunk.slots, data, counts, sketches); writeErr == nil {
+			writeErr = c.write(chunkKey{to, rollup, b.Period, uint32(start)}, chunk)
+		}
+	}
+	if err = iter.Close(); writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+// Close writes everything still in memory
+func (c *chunkStore) Close() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+func mergeSlots(into, from map[uint32]*accumulator) {
+	for t, acc := range from {
+		if existing, ok := into[t]; ok {
+			existing.Merge(*acc)
+		} else {
+			copied := *acc
+			into[t] = &copied
+		}
+	}
+}
+
+// Averages are stored as their sum, so they can still be merged
+func storedValue(acc *accumulator, method aggregate.Method) float64 {
+	if method == aggregate.AVG {
+		return acc.sum
+	}
+	return acc.Value(method)
+}
+
+func storedAccumulator(value float64, count int) accumulator {
+	return accumulator{count: count, sum: value, min: value, max: value, first: value, last: value}
+}
+
+// Percentile sketches are stored after each other, in the same order
+// as the slots, as the number of bins followed by each bin and its count
+func appendSketch(buf []byte, s *sketch) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	if s == nil {
+		return append(buf, 0)
+	}
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(s.bins)))]...)
+	for bin, count := range s.bins {
+		buf = append(buf, tmp[:binary.PutVarint(tmp[:], int64(bin))]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], count)]...)
+	}
+	return buf
+}
+
+// readSketch reads the sketch at the start of buf, returning what's left after it
+func readSketch(buf []byte) (*sketch, []byte, error) {
+	bins, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, nil, errChunkCorrupt
+	}
+	buf = buf[n:]
+	if bins == 0 {
+		return nil, buf, nil
+	}
+	s := newSketch()
+	for i := uint64(0); i < bins; i++ {
+		bin, n := binary.Varint(buf)
+		if n <= 0 {
+			return nil, nil, errChunkCorrupt
+		}
+		buf = buf[n:]
+		count, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, nil, errChunkCorrupt
+		}
+		buf = buf[n:]
+		s.AddBin(int32(bin), count)
+	}
+	return s, buf, nil
+}
+
+const CHUNK_INSERT = `
+INSERT INTO chunks (rollup, period, path, start, data, counts, sketches)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+USING TTL ?
+`
+
+const CHUNK_SELECT_ONE = `
+SELECT data, counts, sketches
+FROM chunks
+WHERE rollup = ? AND period = ? AND path = ? AND start = ?
+`
+
+const CHUNK_SELECT = `
+SELECT data, counts, sketches
+FROM chunks
+WHERE rollup = ? AND period = ? AND path = ? AND start >= ? AND start < ?
+`
+
+const CHUNK_SELECT_ALL = `
+SELECT start, data, counts, sketches
+FROM chunks
+WHERE rollup = ? AND period = ? AND path = ?
+`
+
+const CHUNK_DELETE = `
+DELETE FROM chunks
+WHERE rollup = ? AND period = ? AND path = ?
+`
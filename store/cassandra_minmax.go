@@ -0,0 +1,179 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/metric"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// How many slots we remember the current extreme for
+const MAX_CACHED_EXTREMES = 100000
+
+// How often we retry when racing another writer on an empty slot
+const MAX_EXTREME_ATTEMPTS = 5
+
+// MIN and MAX are written with lightweight transactions, only replacing
+// the stored value when the new one is smaller, or larger. This is correct
+// for every float64, but each transaction is a Paxos round, so we remember
+// the last extreme seen per slot and skip writes that can't change it.
+func (d *CassandraDriver) writeExtreme(path string, time uint32, value float64, agg *aggregate.Rule, b *schema.Bucket) error {
+	key := partitionKey(path, b.Period, int(b.Rollup.Seconds()), int(b.WindowStart(time)))
+	key = append(key, time)
+	slot := fmt.Sprintf("%v", key)
+	if !d.extremes.Improves(slot, value, agg.Method) {
+		return nil
+	}
+
+	age := int(b.Ttl.Seconds())
+	stmts := statementsFor(b.Window > 0)
+	update := stmts.minUpdate
+	if agg.Method == aggregate.MAX {
+		update = stmts.maxUpdate
+	}
+
+	for i := 0; i < MAX_EXTREME_ATTEMPTS; i++ {
+		args := append([]interface{}{age, value}, key...)
+		args = append(args, value)
+		current := make(map[string]interface{})
+		applied, err := d.session.Query(update, args...).MapScanCAS(current)
+		if err != nil {
+			return err
+		}
+		if applied {
+			d.extremes.Set(slot, value)
+			return nil
+		}
+		if data, ok := current["data"].(float64); ok {
+			// Someone already stored something at least as good
+			d.extremes.Set(slot, data)
+			return nil
+		}
+
+		// Nothing stored for this slot yet
+		args = append(append([]interface{}{}, key...), value, age)
+		applied, err = d.session.Query(stmts.minmaxInsert, args...).MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			return err
+		}
+		if applied {
+			d.extremes.Set(slot, value)
+			return nil
+		}
+		// Lost the race to insert, so try to update again
+	}
+	return fmt.Errorf("store/cassandra: gave up writing %v for %s", agg.Method, slot)
+}
+
+// FIRST keeps the first point to arrive for a slot, using an insert that
+// only applies while the slot is empty. Once a slot is known to be filled,
+// later points are skipped without a round trip.
+func (d *CassandraDriver) writeFirst(path string, time uint32, value float64, b *schema.Bucket) error {
+	key := partitionKey(path, b.Period, int(b.Rollup.Seconds()), int(b.WindowStart(time)))
+	key = append(key, time)
+	slot := fmt.Sprintf("%v", key)
+	if !d.extremes.Improves(slot, value, aggregate.FIRST) {
+		return nil
+	}
+	args := append(append([]interface{}{}, key...), value, int(b.Ttl.Seconds()))
+	stmt := statementsFor(b.Window > 0).firstInsert
+	if _, err := d.session.Query(stmt, args...).MapScanCAS(make(map[string]interface{})); err != nil {
+		return err
+	}
+	d.extremes.Set(slot, value)
+	return nil
+}
+
+// writeExtremes reduces a batch down to a single value per slot
+// before writing, so there's only one transaction per slot.
+func (d *CassandraDriver) writeExtremes(path string, points metric.Points, agg *aggregate.Rule, b *schema.Bucket) []error {
+	errs := make([]error, len(points))
+	slots := make(map[uint32][]int)
+	var order []uint32
+	for i, p := range points {
+		time := b.RoundDown(p.GetTimestamp())
+		if _, ok := slots[time]; !ok {
+			order = append(order, time)
+		}
+		slots[time] = append(slots[time], i)
+	}
+	for _, time := range order {
+		indexes := slots[time]
+		value := points[indexes[0]].GetValue()
+		for _, i := range indexes[1:] {
+			v := points[i].GetValue()
+			if (agg.Method == aggregate.MIN && v < value) || (agg.Method == aggregate.MAX && v > value) {
+				value = v
+			}
+		}
+		if err := d.writeExtreme(path, time, value, agg, b); err != nil {
+			for _, i := range indexes {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+// extremeCache remembers the best known MIN or MAX for recent slots,
+// or for FIRST, that the slot has been filled.
+// A cached value is always one that was stored, or was beaten by one
+// that was stored, so a value that doesn't improve on it can be skipped.
+// Slots stop being written once they're in the past, so rather than
+// tracking recency we simply start over once the cache is full.
+type extremeCache struct {
+	max    int
+	values map[string]float64
+	mux    sync.Mutex
+}
+
+func newExtremeCache(max int) *extremeCache {
+	return &extremeCache{
+		max:    max,
+		values: make(map[string]float64),
+	}
+}
+
+// Improves reports whether value could change the stored extreme for slot
+func (c *extremeCache) Improves(slot string, value float64, method aggregate.Method) bool {
+	c.mux.Lock()
+	current, ok := c.values[slot]
+	c.mux.Unlock()
+	if !ok {
+		return true
+	}
+	switch method {
+	case aggregate.FIRST:
+		// Whatever was first is already stored
+		return false
+	case aggregate.MIN:
+		return value < current
+	}
+	return value > current
+}
+
+// Forget drops every slot of path. Slots are keyed by their partition
+// key and time, and paths never contain spaces, so a slot of path is
+// one with path as a word of its own.
+func (c *extremeCache) Forget(path string) {
+	word := " " + path + " "
+	c.mux.Lock()
+	for slot := range c.values {
+		if strings.Contains(slot, word) {
+			delete(c.values, slot)
+		}
+	}
+	c.mux.Unlock()
+}
+
+func (c *extremeCache) Set(slot string, value float64) {
+	c.mux.Lock()
+	if len(c.values) >= c.max {
+		c.values = make(map[string]float64)
+	}
+	c.values[slot] = value
+	c.mux.Unlock()
+}
@@ -0,0 +1,321 @@
+package store
+
+import (
+	"github.com/gocql/gocql"
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	log "github.com/mattrobenolt/mineshaft/logging"
+	"github.com/mattrobenolt/mineshaft/schema"
+	"github.com/mattrobenolt/mineshaft/set"
+
+	"fmt"
+	"sync"
+	"time"
+)
+
+const day = 24 * 60 * 60
+
+// How many partitions we remember having recorded already
+const MAX_TRACKED_PARTITIONS = 100000
+
+// How far back to look for windows that were recorded late,
+// e.g. by writing points with old timestamps
+const RETENTION_LOOKBACK = 7 * day
+
+// Counters can't carry a TTL, so the sum and avg tables need their
+// expired data removed for them. Every counter partition we write
+// to is recorded once, and periodically swept:
+//
+// Time windowed partitions are recorded in counter_windows under the
+// day they expire, and dropped as a whole once that day has come.
+//
+// Plain partitions never expire as a whole, so they're recorded in
+// counter_series and have everything older than their ttl deleted.
+type retention struct {
+	session  *gocql.Session
+	interval time.Duration
+
+	tracked *set.Set
+	mux     sync.Mutex
+
+	stats    RetentionStats
+	statsMux sync.RWMutex
+	done     chan struct{}
+}
+
+// RetentionStats reports on how much expired data has been reclaimed
+// since the process started.
+type RetentionStats struct {
+	Sweeps     int64
+	Partitions int64
+	Series     int64
+	Rows       int64
+	LastSweep  time.Time
+	LastError  string
+}
+
+func newRetention(session *gocql.Session, interval time.Duration) *retention {
+	r := &retention{
+		session:  session,
+		interval: interval,
+		tracked:  set.New(MAX_TRACKED_PARTITIONS),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// counterTable returns the table a counter based aggregation is written
+// to, or an empty string if it isn't stored in a counter
+func counterTable(agg *aggregate.Rule, b *schema.Bucket) string {
+	var table string
+	switch agg.Method {
+	case aggregate.SUM:
+		table = "sum"
+	case aggregate.AVG:
+		table = "avg"
+	case aggregate.COUNT:
+		table = "counts"
+	default:
+		if _, ok := agg.Method.Quantile(); !ok {
+			return ""
+		}
+		table = "sketch"
+	}
+	if b.Window > 0 {
+		table += "_windowed"
+	}
+	return table
+}
+
+// Track records the partition a point was written to, if it
+// hasn't been seen recently.
+func (r *retention) Track(path string, time uint32, agg *aggregate.Rule, b *schema.Bucket) error {
+	table := counterTable(agg, b)
+	if table == "" {
+		return nil
+	}
+	rollup := int(b.Rollup.Seconds())
+	window := int64(b.WindowStart(time))
+	key := fmt.Sprintf("%s %d %d %s %d", table, rollup, b.Period, path, window)
+
+	r.mux.Lock()
+	added := r.tracked.Add(key)
+	r.mux.Unlock()
+	if !added {
+		return nil
+	}
+
+	var err error
+	if b.Window > 0 {
+		expires := window + int64(b.Window.Seconds()) + int64(b.Ttl.Seconds())
+		expires = (expires + day - 1) / day * day
+		err = r.session.Query(
+			COUNTER_WINDOWS_INSERT,
+			expires, table, rollup, b.Period, path, window,
+		).Exec()
+	} else {
+		err = r.session.Query(
+			COUNTER_SERIES_INSERT,
+			table, rollup, b.Period, path, int(b.Ttl.Seconds()),
+		).Exec()
+	}
+	if err != nil {
+		// Try again next time around
+		r.mux.Lock()
+		r.tracked.Remove(key)
+		r.mux.Unlock()
+	}
+	return err
+}
+
+func (r *retention) Stats() RetentionStats {
+	r.statsMux.RLock()
+	defer r.statsMux.RUnlock()
+	return r.stats
+}
+
+func (r *retention) Close() {
+	close(r.done)
+}
+
+func (r *retention) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.sweep()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *retention) sweep() {
+	start := time.Now()
+	now := start.Unix()
+	var partitions, series, rows int64
+
+	var err error
+	for expires := (now-RETENTION_LOOKBACK)/day*day + day; expires <= now; expires += day {
+		var p, n int64
+		if p, n, err = r.sweepWindows(expires); err != nil {
+			break
+		}
+		partitions += p
+		rows += n
+	}
+	if err == nil {
+		var n int64
+		series, n, err = r.sweepSeries(now)
+		rows += n
+	}
+
+	r.statsMux.Lock()
+	r.stats.Sweeps++
+	r.stats.Partitions += partitions
+	r.stats.Series += series
+	r.stats.Rows += rows
+	r.stats.LastSweep = start
+	r.stats.LastError = ""
+	if err != nil {
+		r.stats.LastError = err.Error()
+	}
+	r.statsMux.Unlock()
+
+	if err != nil {
+		log.Println("store/retention: sweep failed:", err)
+	}
+	log.Println("store/retention: dropped", partitions, "partitions, trimmed", series, "series,", rows, "rows in", time.Now().Sub(start))
+}
+
+// sweepWindows drops every windowed partition that expired on the given day
+func (r *retention) sweepWindows(expires int64) (partitions, rows int64, err error) {
+	var (
+		table, path    string
+		rollup, period int
+		window, count  int64
+	)
+	iter := r.session.Query(COUNTER_WINDOWS_SELECT, expires).Iter()
+	for iter.Scan(&table, &rollup, &period, &path, &window) {
+		if !isCounterTable(table) {
+			continue
+		}
+		key := []interface{}{rollup, period, path, window}
+		if err = r.session.Query(fmt.Sprintf(COUNTER_WINDOW_COUNT, table), key...).Scan(&count); err != nil {
+			iter.Close()
+			return
+		}
+		if err = r.session.Query(fmt.Sprintf(COUNTER_WINDOW_DELETE, table), key...).Exec(); err != nil {
+			iter.Close()
+			return
+		}
+		partitions++
+		rows += count
+	}
+	if err = iter.Close(); err != nil {
+		return
+	}
+	err = r.session.Query(COUNTER_WINDOWS_DELETE, expires).Exec()
+	return
+}
+
+// sweepSeries deletes everything older than the ttl from every plain
+// counter partition
+func (r *retention) sweepSeries(now int64) (series, rows int64, err error) {
+	var (
+		table, path         string
+		rollup, period, ttl int
+		count               int64
+	)
+	iter := r.session.Query(COUNTER_SERIES_SELECT).Iter()
+	for iter.Scan(&table, &rollup, &period, &path, &ttl) {
+		if !isCounterTable(table) {
+			continue
+		}
+		args := []interface{}{rollup, period, path, now - int64(ttl)}
+		if err = r.session.Query(fmt.Sprintf(COUNTER_EXPIRED_COUNT, table), args...).Scan(&count); err != nil {
+			iter.Close()
+			return
+		}
+		if count == 0 {
+			continue
+		}
+		if err = r.session.Query(fmt.Sprintf(COUNTER_EXPIRED_DELETE, table), args...).Exec(); err != nil {
+			iter.Close()
+			return
+		}
+		series++
+		rows += count
+	}
+	err = iter.Close()
+	return
+}
+
+// Table names are interpolated into statements, so
+// only ever accept the ones we know about
+func isCounterTable(table string) bool {
+	switch table {
+	case "sum", "avg", "counts", "sketch",
+		"sum_windowed", "avg_windowed", "counts_windowed", "sketch_windowed":
+		return true
+	}
+	return false
+}
+
+// RetentionStats reports on data reclaimed from the counter tables,
+// false if retention isn't enabled with retention_interval
+func (d *CassandraDriver) RetentionStats() (RetentionStats, bool) {
+	if d.retention == nil {
+		return RetentionStats{}, false
+	}
+	return d.retention.Stats(), true
+}
+
+const COUNTER_WINDOWS_INSERT = `
+INSERT INTO counter_windows (expires, tbl, rollup, period, path, window_start)
+VALUES (?, ?, ?, ?, ?, ?)
+`
+
+const COUNTER_WINDOWS_SELECT = `
+SELECT tbl, rollup, period, path, window_start
+FROM counter_windows
+WHERE expires = ?
+`
+
+const COUNTER_WINDOWS_DELETE = `
+DELETE FROM counter_windows
+WHERE expires = ?
+`
+
+const COUNTER_SERIES_INSERT = `
+INSERT INTO counter_series (tbl, rollup, period, path, ttl)
+VALUES (?, ?, ?, ?, ?)
+`
+
+const COUNTER_SERIES_SELECT = `
+SELECT tbl, rollup, period, path, ttl
+FROM counter_series
+`
+
+const COUNTER_WINDOW_COUNT = `
+SELECT COUNT(*)
+FROM %s
+WHERE rollup = ? AND period = ? AND path = ? AND window_start = ?
+`
+
+const COUNTER_WINDOW_DELETE = `
+DELETE FROM %s
+WHERE rollup = ? AND period = ? AND path = ? AND window_start = ?
+`
+
+const COUNTER_EXPIRED_COUNT = `
+SELECT COUNT(*)
+FROM %s
+WHERE rollup = ? AND period = ? AND path = ? AND time < ?
+`
+
+const COUNTER_EXPIRED_DELETE = `
+DELETE FROM %s
+WHERE rollup = ? AND period = ? AND path = ? AND time < ?
+`
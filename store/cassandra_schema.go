@@ -0,0 +1,377 @@
+package store
+
+import (
+	"github.com/gocql/gocql"
+	log "github.com/mattrobenolt/mineshaft/logging"
+
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A migration is a single, versioned change to the tables in our keyspace.
+// Statements are format strings, and are passed the compaction class as
+// their only argument. Every statement must be safe to run more than once,
+// since two nodes may race to apply the same migration. Cassandra has no
+// IF NOT EXISTS for adding a column, so an ALTER that fails because the
+// column is already there counts as applied.
+//
+// Never edit a migration that has already shipped, append a new one instead.
+type migration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+var migrations = []migration{
+	{1, "create avg, sum and minmaxlast tables", []string{
+		// Calculate average by data/count
+		// Update by incrementing data by value and count by 1
+		`CREATE TABLE IF NOT EXISTS avg (
+			period int,
+			rollup int,
+			path text,
+			time bigint,
+			data counter,
+			count counter,
+			PRIMARY KEY ((period, rollup, path), time)
+		) WITH ` + tableOptions,
+		// Just simply update the data counter
+		`CREATE TABLE IF NOT EXISTS sum (
+			period int,
+			rollup int,
+			path text,
+			time bigint,
+			data counter,
+			PRIMARY KEY ((period, rollup, path), time)
+		) WITH ` + tableOptions,
+		// Just keep updating data with the last value seen
+		// They only differ on how we actually write the data
+		`CREATE TABLE IF NOT EXISTS minmaxlast (
+			period int,
+			rollup int,
+			path text,
+			time bigint,
+			data double,
+			PRIMARY KEY ((period, rollup, path), time)
+		) WITH ` + tableOptions,
+	}},
+	{2, "create time windowed avg, sum and minmaxlast tables", []string{
+		`CREATE TABLE IF NOT EXISTS avg_windowed (
+			period int,
+			rollup int,
+			path text,
+			window_start bigint,
+			time bigint,
+			data counter,
+			count counter,
+			PRIMARY KEY ((period, rollup, path, window_start), time)
+		) WITH ` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS sum_windowed (
+			period int,
+			rollup int,
+			path text,
+			window_start bigint,
+			time bigint,
+			data counter,
+			PRIMARY KEY ((period, rollup, path, window_start), time)
+		) WITH ` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS minmaxlast_windowed (
+			period int,
+			rollup int,
+			path text,
+			window_start bigint,
+			time bigint,
+			data double,
+			PRIMARY KEY ((period, rollup, path, window_start), time)
+		) WITH ` + tableOptions,
+	}},
+	{3, "create minmax tables written with lightweight transactions", []string{
+		// Only updated when a new value beats the stored one, using
+		// IF data < ? or IF data > ?, so min and max are stored apart
+		// from last which is a blind write
+		`CREATE TABLE IF NOT EXISTS minmax (
+			period int,
+			rollup int,
+			path text,
+			time bigint,
+			data double,
+			PRIMARY KEY ((period, rollup, path), time)
+		) WITH ` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS minmax_windowed (
+			period int,
+			rollup int,
+			path text,
+			window_start bigint,
+			time bigint,
+			data double,
+			PRIMARY KEY ((period, rollup, path, window_start), time)
+		) WITH ` + tableOptions,
+	}},
+	{4, "create counter_windows and counter_series for retention", []string{
+		// Windowed counter partitions, by the day they can be dropped
+		`CREATE TABLE IF NOT EXISTS counter_windows (
+			expires bigint,
+			tbl text,
+			rollup int,
+			period int,
+			path text,
+			window_start bigint,
+			PRIMARY KEY ((expires), tbl, rollup, period, path, window_start)
+		) WITH ` + tableOptions,
+		// Plain counter partitions, trimmed to their ttl
+		`CREATE TABLE IF NOT EXISTS counter_series (
+			tbl text,
+			rollup int,
+			period int,
+			path text,
+			ttl int,
+			PRIMARY KEY ((tbl, rollup, period, path))
+		) WITH ` + tableOptions,
+	}},
+	{5, "create chunks for layout=chunks", []string{
+		// Gorilla encoded slots, CHUNK_POINTS per row, with the
+		// count of points in each slot encoded alongside, and the
+		// sketch of each slot for percentiles
+		`CREATE TABLE IF NOT EXISTS chunks (
+			period int,
+			rollup int,
+			path text,
+			start bigint,
+			data blob,
+			counts blob,
+			sketches blob,
+			PRIMARY KEY ((period, rollup, path), start)
+		) WITH ` + tableOptions,
+	}},
+	{6, "create counts, first and sketch for the count, first and percentile methods", []string{
+		`CREATE TABLE IF NOT EXISTS counts (
+			period int,
+			rollup int,
+			path text,
+			time bigint,
+			data counter,
+			PRIMARY KEY ((period, rollup, path), time)
+		) WITH ` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS counts_windowed (
+			period int,
+			rollup int,
+			path text,
+			window_start bigint,
+			time bigint,
+			data counter,
+			PRIMARY KEY ((period, rollup, path, window_start), time)
+		) WITH ` + tableOptions,
+		// Only ever inserted with IF NOT EXISTS
+		`CREATE TABLE IF NOT EXISTS first (
+			period int,
+			rollup int,
+			path text,
+			time bigint,
+			data double,
+			PRIMARY KEY ((period, rollup, path), time)
+		) WITH ` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS first_windowed (
+			period int,
+			rollup int,
+			path text,
+			window_start bigint,
+			time bigint,
+			data double,
+			PRIMARY KEY ((period, rollup, path, window_start), time)
+		) WITH ` + tableOptions,
+		// A counter per bin of each slot's sketch
+		`CREATE TABLE IF NOT EXISTS sketch (
+			period int,
+			rollup int,
+			path text,
+			time bigint,
+			bin int,
+			count counter,
+			PRIMARY KEY ((period, rollup, path), time, bin)
+		) WITH ` + tableOptions,
+		`CREATE TABLE IF NOT EXISTS sketch_windowed (
+			period int,
+			rollup int,
+			path text,
+			window_start bigint,
+			time bigint,
+			bin int,
+			count counter,
+			PRIMARY KEY ((period, rollup, path, window_start), time, bin)
+		) WITH ` + tableOptions,
+		// Only for keyspaces that created chunks before it had sketches
+		`ALTER TABLE chunks ADD sketches blob`,
+	}},
+}
+
+const tableOptions = `
+	compaction = {'class': '%[1]s'} AND
+	compression = {'class': 'LZ4Compressor'} AND
+	gc_grace_seconds = 86400`
+
+const MIGRATIONS_CREATE = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version int PRIMARY KEY,
+  description text,
+  applied timestamp
+)
+`
+
+const MIGRATIONS_SELECT = `
+SELECT version FROM schema_migrations
+`
+
+const MIGRATIONS_INSERT = `
+INSERT INTO schema_migrations (version, description, applied)
+VALUES (?, ?, ?)
+`
+
+var validIdentifier = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+
+// provisionOptions control how the keyspace and tables are created
+// and are all read from the connection url:
+//
+//	create_schema       create the keyspace and run migrations, default false
+//	replication         SimpleStrategy (default) or NetworkTopologyStrategy
+//	replication_factor  for SimpleStrategy, default 1
+//	replication_dcs     for NetworkTopologyStrategy, e.g. dc1:3,dc2:3
+//	compaction          compaction class, default SizeTieredCompactionStrategy
+type provisionOptions struct {
+	Create      bool
+	Replication string
+	Compaction  string
+}
+
+func parseProvisionOptions(url *url.URL) (*provisionOptions, error) {
+	q := url.Query()
+	o := &provisionOptions{
+		Compaction: "SizeTieredCompactionStrategy",
+	}
+	if v := q.Get("create_schema"); v != "" {
+		var err error
+		if o.Create, err = strconv.ParseBool(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("compaction"); v != "" {
+		if !validIdentifier.MatchString(v) {
+			return nil, fmt.Errorf("store/cassandra: invalid compaction %q", v)
+		}
+		o.Compaction = v
+	}
+
+	switch q.Get("replication") {
+	case "", "SimpleStrategy":
+		factor := 1
+		if v := q.Get("replication_factor"); v != "" {
+			var err error
+			if factor, err = strconv.Atoi(v); err != nil {
+				return nil, err
+			}
+		}
+		o.Replication = fmt.Sprintf("{'class': 'SimpleStrategy', 'replication_factor': %d}", factor)
+	case "NetworkTopologyStrategy":
+		dcs := q.Get("replication_dcs")
+		if dcs == "" {
+			return nil, errors.New("store/cassandra: NetworkTopologyStrategy requires replication_dcs")
+		}
+		pieces := []string{"'class': 'NetworkTopologyStrategy'"}
+		for _, dc := range strings.Split(dcs, ",") {
+			kv := strings.SplitN(dc, ":", 2)
+			if len(kv) != 2 || !validIdentifier.MatchString(kv[0]) {
+				return nil, fmt.Errorf("store/cassandra: invalid replication_dcs %q", dcs)
+			}
+			factor, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			pieces = append(pieces, fmt.Sprintf("'%s': %d", kv[0], factor))
+		}
+		o.Replication = "{" + strings.Join(pieces, ", ") + "}"
+	default:
+		return nil, fmt.Errorf("store/cassandra: unknown replication %q", q.Get("replication"))
+	}
+	return o, nil
+}
+
+// createKeyspace creates the configured keyspace if it's missing.
+// We can't connect to a keyspace that doesn't exist yet, so this
+// uses its own short lived session without one.
+func createKeyspace(cluster *gocql.ClusterConfig, o *provisionOptions) error {
+	if !validIdentifier.MatchString(cluster.Keyspace) {
+		return fmt.Errorf("store/cassandra: invalid keyspace %q", cluster.Keyspace)
+	}
+	admin := *cluster
+	admin.Keyspace = ""
+	session, err := admin.CreateSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	log.Println("store/cassandra: ensuring keyspace", cluster.Keyspace, o.Replication)
+	return session.Query(fmt.Sprintf(
+		"CREATE KEYSPACE IF NOT EXISTS %s WITH replication = %s",
+		cluster.Keyspace, o.Replication,
+	)).Exec()
+}
+
+// migrate brings the tables up to date by applying, in order, every
+// migration that hasn't been recorded in schema_migrations yet.
+func migrate(session *gocql.Session, o *provisionOptions) error {
+	if err := session.Query(MIGRATIONS_CREATE).Exec(); err != nil {
+		return err
+	}
+
+	applied := make(map[int]bool)
+	var version int
+	iter := session.Query(MIGRATIONS_SELECT).Iter()
+	for iter.Scan(&version) {
+		applied[version] = true
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		log.Println("store/cassandra: applying migration", m.Version, m.Description)
+		for _, stmt := range m.Statements {
+			if strings.Contains(stmt, "%") {
+				stmt = fmt.Sprintf(stmt, o.Compaction)
+			}
+			err := session.Query(stmt).Exec()
+			if err != nil && columnExists(stmt, err) {
+				log.Println("store/cassandra: migration", m.Version, "already applied:", err)
+				err = nil
+			}
+			if err != nil {
+				return fmt.Errorf("store/cassandra: migration %d: %s", m.Version, err)
+			}
+		}
+		if err := session.Query(
+			MIGRATIONS_INSERT,
+			m.Version, m.Description, time.Now(),
+		).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// columnExists reports whether stmt failed because it adds a column
+// that's already there. Cassandra 4 says it already exists, while
+// earlier versions say it conflicts with an existing column.
+func columnExists(stmt string, err error) bool {
+	if !strings.HasPrefix(strings.TrimSpace(stmt), "ALTER TABLE") {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "already exists") || strings.Contains(msg, "conflicts with an existing column")
+}
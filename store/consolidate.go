@@ -0,0 +1,180 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"encoding/json"
+	"math"
+)
+
+// A Segment is part of a series read from a single bucket
+type Segment struct {
+	Range *schema.Range
+	Data  NullFloat64s
+}
+
+func (s *Segment) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"from":   s.Range.Lower,
+		"to":     s.Range.Upper,
+		"step":   s.Range.Rollup,
+		"series": s.Data,
+	})
+}
+
+func (s *Segment) Release() {
+	s.Data.Release()
+}
+
+type Segments []*Segment
+
+func (ss Segments) Release() {
+	for _, s := range ss {
+		s.Release()
+	}
+}
+
+// Consolidate groups the points of data, read over r, into the
+// coarser steps of out, combining each group with method. A step
+// where less than xFilesFactor of its points are known is null.
+// Points of a COUNT series are already counts, so they're summed.
+// Returns a newly allocated series, data is left untouched.
+func Consolidate(data NullFloat64s, r, out *schema.Range, method aggregate.Method, xFilesFactor float64) NullFloat64s {
+	if method == aggregate.COUNT {
+		method = aggregate.SUM
+	}
+	n := out.Len()
+	acc := make([]accumulator, n)
+	for i, v := range data {
+		if v == nil || !v.Valid {
+			continue
+		}
+		j := out.Index(int64(r.Lower + i*r.Rollup))
+		if j < 0 || j >= n {
+			continue
+		}
+		acc[j].Add(v.Float64, method)
+	}
+	series := make(NullFloat64s, n)
+	needed := xFilesFactor * float64(out.Rollup/r.Rollup)
+	for j := range acc {
+		if acc[j].count > 0 && float64(acc[j].count) >= needed {
+			series[j] = NewNullFloat64(acc[j].Value(method), true)
+		}
+	}
+	return series
+}
+
+// Stitch joins segments from different buckets into a single series,
+// consolidated to the coarsest step among them using method. Where
+// segments overlap, the coarser one wins, since the finer one only
+// covers part of that step.
+func Stitch(segments Segments, from, to int, method aggregate.Method) (*schema.Range, NullFloat64s) {
+	step := 0
+	for _, s := range segments {
+		if s.Range.Rollup > step {
+			step = s.Range.Rollup
+		}
+	}
+	out := schema.NewRange(from, to, step)
+	series := make(NullFloat64s, out.Len())
+	// Segments are ordered finest first
+	for _, s := range segments {
+		data := s.Data
+		if s.Range.Rollup != step {
+			data = Consolidate(s.Data, s.Range, out, method, 0)
+		}
+		for i, v := range data {
+			if v == nil || !v.Valid {
+				continue
+			}
+			j := i
+			if s.Range.Rollup == step {
+				j = out.Index(int64(s.Range.Lower + i*step))
+			}
+			if j < 0 || j >= len(series) {
+				continue
+			}
+			if series[j] != nil {
+				series[j].Release()
+			}
+			series[j] = NewNullFloat64(v.Float64, true)
+		}
+		if s.Range.Rollup != step {
+			data.Release()
+		}
+	}
+	return out, series
+}
+
+type accumulator struct {
+	count                      int
+	sum, min, max, first, last float64
+	// Only kept for percentiles
+	sketch *sketch
+}
+
+func (a *accumulator) Add(v float64, method aggregate.Method) {
+	if a.count == 0 {
+		a.min, a.max, a.first = v, v, v
+	}
+	a.count++
+	a.sum += v
+	a.min = math.Min(a.min, v)
+	a.max = math.Max(a.max, v)
+	a.last = v
+	if _, ok := method.Quantile(); ok {
+		if a.sketch == nil {
+			a.sketch = newSketch()
+		}
+		a.sketch.Add(v)
+	}
+}
+
+// Merge adds everything accumulated in b, as if it was added after a
+func (a *accumulator) Merge(b accumulator) {
+	if b.count == 0 {
+		return
+	}
+	if a.count == 0 {
+		*a = b
+		if b.sketch != nil {
+			a.sketch = newSketch()
+			a.sketch.Merge(b.sketch)
+		}
+		return
+	}
+	a.count += b.count
+	a.sum += b.sum
+	a.min = math.Min(a.min, b.min)
+	a.max = math.Max(a.max, b.max)
+	a.last = b.last
+	if b.sketch != nil {
+		if a.sketch == nil {
+			a.sketch = newSketch()
+		}
+		a.sketch.Merge(b.sketch)
+	}
+}
+
+func (a *accumulator) Value(method aggregate.Method) float64 {
+	switch method {
+	case aggregate.MIN:
+		return a.min
+	case aggregate.MAX:
+		return a.max
+	case aggregate.SUM:
+		return a.sum
+	case aggregate.LAST:
+		return a.last
+	case aggregate.COUNT:
+		return float64(a.count)
+	case aggregate.FIRST:
+		return a.first
+	}
+	if q, ok := method.Quantile(); ok && a.sketch != nil {
+		return a.sketch.Quantile(q)
+	}
+	return a.sum / float64(a.count)
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"testing"
+)
+
+// series builds a series from values, with nil for nulls
+func series(values ...interface{}) NullFloat64s {
+	data := make(NullFloat64s, len(values))
+	for i, v := range values {
+		if f, ok := v.(float64); ok {
+			data[i] = NewNullFloat64(f, true)
+		}
+	}
+	return data
+}
+
+func values(data NullFloat64s) []interface{} {
+	out := make([]interface{}, len(data))
+	for i, v := range data {
+		if v != nil && v.Valid {
+			out[i] = v.Float64
+		}
+	}
+	return out
+}
+
+func sameValues(a, b []interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestConsolidate(t *testing.T) {
+	// Ten one minute slots, consolidated into two of five minutes
+	r := schema.NewRange(0, 600, 60)
+	out := schema.NewRange(0, 600, 300)
+	full := series(1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0)
+	sparse := series(1.0, nil, 3.0, 4.0, 5.0, 6.0, nil, nil, nil, 10.0)
+
+	for _, tc := range []struct {
+		method aggregate.Method
+		data   NullFloat64s
+		xff    float64
+		want   []interface{}
+	}{
+		{aggregate.SUM, full, 0, []interface{}{15.0, 40.0}},
+		{aggregate.AVG, full, 0, []interface{}{3.0, 8.0}},
+		{aggregate.MIN, full, 0, []interface{}{1.0, 6.0}},
+		{aggregate.MAX, full, 0, []interface{}{5.0, 10.0}},
+		{aggregate.FIRST, full, 0, []interface{}{1.0, 6.0}},
+		{aggregate.LAST, full, 0, []interface{}{5.0, 10.0}},
+		// Each point is already a count, so they add up
+		{aggregate.COUNT, full, 0, []interface{}{15.0, 40.0}},
+		{aggregate.SUM, sparse, 0, []interface{}{13.0, 16.0}},
+		{aggregate.AVG, sparse, 0, []interface{}{3.25, 8.0}},
+		// 4 of 5 known passes 0.8, 2 of 5 doesn't pass 0.5
+		{aggregate.SUM, sparse, 0.8, []interface{}{13.0, nil}},
+		{aggregate.SUM, sparse, 0.5, []interface{}{13.0, nil}},
+		{aggregate.SUM, sparse, 0.4, []interface{}{13.0, 16.0}},
+	} {
+		got := Consolidate(tc.data, r, out, tc.method, tc.xff)
+		if !sameValues(values(got), tc.want) {
+			t.Errorf("Consolidate(%v, xff %v) = %v, want %v", tc.method, tc.xff, values(got), tc.want)
+		}
+		got.Release()
+	}
+}
+
+func TestStitch(t *testing.T) {
+	fine := &Segment{schema.NewRange(0, 600, 60), series(1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0)}
+	// Overlaps the second step of fine, and wins there
+	coarse := &Segment{schema.NewRange(300, 1200, 300), series(100.0, 200.0, 300.0)}
+
+	for _, tc := range []struct {
+		method aggregate.Method
+		want   []interface{}
+	}{
+		{aggregate.SUM, []interface{}{15.0, 100.0, 200.0, 300.0}},
+		{aggregate.AVG, []interface{}{3.0, 100.0, 200.0, 300.0}},
+		{aggregate.MIN, []interface{}{1.0, 100.0, 200.0, 300.0}},
+		{aggregate.MAX, []interface{}{5.0, 100.0, 200.0, 300.0}},
+		{aggregate.FIRST, []interface{}{1.0, 100.0, 200.0, 300.0}},
+		{aggregate.LAST, []interface{}{5.0, 100.0, 200.0, 300.0}},
+		{aggregate.COUNT, []interface{}{15.0, 100.0, 200.0, 300.0}},
+	} {
+		out, got := Stitch(Segments{fine, coarse}, 0, 1200, tc.method)
+		if out.Rollup != 300 {
+			t.Errorf("Stitch(%v) step = %d, want 300", tc.method, out.Rollup)
+		}
+		if !sameValues(values(got), tc.want) {
+			t.Errorf("Stitch(%v) = %v, want %v", tc.method, values(got), tc.want)
+		}
+		got.Release()
+	}
+}
+
+func TestDropSparse(t *testing.T) {
+	// Slots of five minutes, each with five one minute slots finer than it
+	for _, tc := range []struct {
+		samples NullFloat64s
+		xff     float64
+		want    []interface{}
+	}{
+		{series(5.0, 2.0, 1.0), 0.3, []interface{}{1.0, 2.0, nil}},
+		{series(5.0, 2.0, 1.0), 0.2, []interface{}{1.0, 2.0, 3.0}},
+		// More points than finer slots is still just all of them
+		{series(10.0, 4.0, nil), 1, []interface{}{1.0, nil, nil}},
+		// Nothing counted at all, so nothing to go by
+		{series(nil, nil, nil), 0.5, []interface{}{1.0, 2.0, 3.0}},
+	} {
+		data := series(1.0, 2.0, 3.0)
+		dropSparse(data, tc.samples, 5, tc.xff)
+		if !sameValues(values(data), tc.want) {
+			t.Errorf("dropSparse(%v, xff %v) = %v, want %v", values(tc.samples), tc.xff, values(data), tc.want)
+		}
+		data.Release()
+	}
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/metric"
+
+	"math"
+	"sync"
+	"time"
+)
+
+// Roughly how much memory each sample remembered takes up on top of
+// its path, which every parsed point has a copy of, kept alive by the key
+const DEDUPE_SAMPLE_SIZE = 48
+
+type dedupeKey struct {
+	path      string
+	timestamp uint32
+	value     uint64
+}
+
+// deduper remembers the samples written over the last window, so that
+// ones sent again, by a client resending its buffer after reconnecting,
+// aren't counted twice. Samples are kept in two generations of a window
+// each, so one is remembered for between one and two windows. Once a
+// generation takes up half of maxBytes it's retired early, shortening
+// the window rather than growing without bound.
+type deduper struct {
+	window   time.Duration
+	maxBytes int64
+
+	current, previous           map[dedupeKey]struct{}
+	currentBytes, previousBytes int64
+	rotated                     time.Time
+	hits, samples               int64
+	mux                         sync.Mutex
+}
+
+type DedupeStats struct {
+	// Samples checked, and how many of those were dropped
+	Samples, Hits int64
+	// Samples currently remembered, and roughly how many bytes they take
+	Held  int
+	Bytes int64
+}
+
+func newDeduper(window time.Duration, budget int64) *deduper {
+	return &deduper{
+		window:   window,
+		maxBytes: budget,
+		current:  make(map[dedupeKey]struct{}),
+		previous: make(map[dedupeKey]struct{}),
+		rotated:  time.Now(),
+	}
+}
+
+// Seen reports whether the same sample was already seen within the
+// window, and remembers it if it wasn't. A sample that then fails to
+// be written has to be forgotten again, so that it's written once resent.
+func (d *deduper) Seen(p *metric.Point, now time.Time) bool {
+	key := dedupeKey{p.GetPath(), p.GetTimestamp(), math.Float64bits(p.GetValue())}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.samples++
+	if now.Sub(d.rotated) >= d.window || d.currentBytes >= d.maxBytes/2 {
+		d.previous, d.current = d.current, make(map[dedupeKey]struct{})
+		d.previousBytes, d.currentBytes = d.currentBytes, 0
+		d.rotated = now
+	}
+	if _, ok := d.current[key]; ok {
+		d.hits++
+		return true
+	}
+	if _, ok := d.previous[key]; ok {
+		d.hits++
+		return true
+	}
+	d.current[key] = struct{}{}
+	d.currentBytes += int64(DEDUPE_SAMPLE_SIZE + len(key.path))
+	return false
+}
+
+// Forget drops a sample remembered by Seen
+func (d *deduper) Forget(path string, timestamp uint32, value float64) {
+	key := dedupeKey{path, timestamp, math.Float64bits(value)}
+	size := int64(DEDUPE_SAMPLE_SIZE + len(path))
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if _, ok := d.current[key]; ok {
+		delete(d.current, key)
+		d.currentBytes -= size
+	}
+	if _, ok := d.previous[key]; ok {
+		delete(d.previous, key)
+		d.previousBytes -= size
+	}
+}
+
+func (d *deduper) Stats() DedupeStats {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return DedupeStats{
+		Samples: d.samples,
+		Hits:    d.hits,
+		Held:    len(d.current) + len(d.previous),
+		Bytes:   d.currentBytes + d.previousBytes,
+	}
+}
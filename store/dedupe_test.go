@@ -0,0 +1,121 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/metric"
+
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func point(path string, timestamp uint32, value float64) *metric.Point {
+	p := metric.New()
+	p.SetPath(path)
+	p.SetTimestamp(timestamp)
+	p.SetValue(value)
+	return p
+}
+
+// A sample seen after offset, and whether it should be a duplicate
+type dedupeStep struct {
+	path   string
+	value  float64
+	offset time.Duration
+	seen   bool
+}
+
+func TestDedupe(t *testing.T) {
+	start := time.Unix(1000, 0)
+	short := "a.b"
+	long := strings.Repeat("x", 100)
+	// Room for two samples of short per generation
+	budget := int64(4 * (DEDUPE_SAMPLE_SIZE + len(short)))
+
+	for _, tc := range []struct {
+		name   string
+		budget int64
+		steps  []dedupeStep
+	}{
+		{"within a window", 1 << 20, []dedupeStep{
+			{short, 1, 0, false},
+			{short, 1, time.Second, true},
+			{short, 2, time.Second, false},
+		}},
+		{"rolled over by time", 1 << 20, []dedupeStep{
+			{short, 1, 0, false},
+			// Retired into the previous generation, still remembered
+			{short, 1, 15 * time.Second, true},
+			// Both generations are gone
+			{short, 1, 45 * time.Second, false},
+		}},
+		{"rolled over by size", budget, []dedupeStep{
+			{short, 1, 0, false},
+			{short, 2, 0, false},
+			// The first generation is full, and retired
+			{short, 3, 0, false},
+			{short, 1, 0, true},
+			{short, 4, 0, false},
+			// Retired again, so the first two are forgotten
+			{short, 5, 0, false},
+			{short, 2, 0, false},
+			{short, 5, 0, true},
+		}},
+		{"paths count towards the budget", budget, []dedupeStep{
+			// A long path alone fills a generation
+			{long, 1, 0, false},
+			{long, 2, 0, false},
+			{long, 3, 0, false},
+			{long, 1, 0, false},
+		}},
+	} {
+		d := newDeduper(10*time.Second, tc.budget)
+		d.rotated = start
+		for i, step := range tc.steps {
+			p := point(step.path, 60, step.value)
+			if seen := d.Seen(p, start.Add(step.offset)); seen != step.seen {
+				t.Errorf("%s: step %d Seen(%v) = %v, want %v", tc.name, i, step.value, seen, step.seen)
+			}
+			p.Release()
+		}
+	}
+}
+
+func TestDedupeFailedWrite(t *testing.T) {
+	s, driver := newMemoryStore(t, "1min:1d", "avg,max", "a.b")
+	s.SetDedupe(time.Minute, 1<<20)
+	r := s.GetBuckets("a.b")[0].Range(60, 180)
+	read := func() []interface{} {
+		data, err := driver.Get("a.b", r, s.aggregation.Match("a.b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer data.Release()
+		return values(data)
+	}
+
+	p := point("a.b", 60, 1)
+	defer p.Release()
+	driver.err = errors.New("down")
+	if err := s.Set(p); err == nil {
+		t.Fatal("Set succeeded with the driver down")
+	}
+	driver.err = nil
+	// Resent once the client reconnects
+	if err := s.Set(p); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(), []interface{}{1.0, nil}; !sameValues(got, want) {
+		t.Errorf("after resending = %v, want %v", got, want)
+	}
+	// And once more, which is a duplicate
+	if err := s.Set(p); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(), []interface{}{1.0, nil}; !sameValues(got, want) {
+		t.Errorf("after a duplicate = %v, want %v", got, want)
+	}
+	if stats, _ := s.DedupeStats(); stats.Hits != 1 {
+		t.Errorf("dedupe hits = %d, want 1", stats.Hits)
+	}
+}
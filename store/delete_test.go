@@ -0,0 +1,39 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestDeleteDryRun(t *testing.T) {
+	s, _ := newMemoryStore(t, "1min:1d", "sum", "a.b.x", "a.b.y", "a.c.x", "d.x")
+
+	result, err := s.Delete("a.b.*", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a.b is left empty, while a still has a.c
+	want := []string{"a.b.x", "a.b.y", "a.b"}
+	if len(result.Index) != len(want) {
+		t.Fatalf("dry run would remove %v from the index, want %v", result.Index, want)
+	}
+	for i, key := range want {
+		if result.Index[i] != key {
+			t.Errorf("dry run would remove %v from the index, want %v", result.Index, want)
+			break
+		}
+	}
+	if !result.DryRun || len(result.Paths) != 2 {
+		t.Errorf("dry run result %+v", result)
+	}
+	if paths, _ := s.index.QueryAll("a.b.*"); len(paths) != 2 {
+		t.Errorf("dry run removed %d of a.b.*", 2-len(paths))
+	}
+
+	result, err = s.Delete("d.x", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Index) != 2 || result.Index[0] != "d.x" || result.Index[1] != "d" {
+		t.Errorf("dry run would remove %v from the index, want [d.x d]", result.Index)
+	}
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"fmt"
+	"sort"
+	"time"
+)
+
+// How many slots of each series are read at a time when exporting
+const EXPORT_CHUNK_POINTS = 1440
+
+type ExportOptions struct {
+	// Rollup of the bucket to read from, rather than the finest
+	Resolution time.Duration
+	// Which of the methods a series is aggregated by to read
+	Method *aggregate.Method
+	// How many series are read together. The whole range is read for
+	// one batch before moving on to the next, so a batch of every
+	// series, the default, has them all side by side in each chunk.
+	Batch int
+}
+
+// A stretch of EXPORT_CHUNK_POINTS slots, or less, of a batch of series
+type ExportChunk struct {
+	Paths []string
+	// Slot i of each series starts at Lower + i*Rollup
+	Lower, Rollup int
+	Data          []NullFloat64s
+}
+
+// Release is safe on a nil chunk, which is what a failed read returns
+func (c *ExportChunk) Release() {
+	if c == nil {
+		return
+	}
+	for _, data := range c.Data {
+		data.Release()
+	}
+}
+
+// Export reads every series matching query over from-to out of a single
+// bucket, a chunk at a time, so that exports of any size only hold one
+// chunk of a batch of series in memory. Every series has to be read at
+// the same rollup, so they line up. Chunks are released once fn returns.
+func (s *Store) Export(query string, from, to int, opts ExportOptions, fn func(*ExportChunk) error) error {
+	found, err := s.index.QueryAll(query)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, p := range found {
+		if p.Leaf {
+			paths = append(paths, p.Key)
+		}
+	}
+	sort.Strings(paths)
+
+	rollup := time.Duration(0)
+	buckets := make(map[string]*schema.Bucket, len(paths))
+	for _, path := range paths {
+		b, err := s.exportBucket(path, opts.Resolution)
+		if err != nil {
+			return err
+		}
+		if rollup == 0 {
+			rollup = b.Rollup
+		} else if b.Rollup != rollup {
+			return fmt.Errorf("store: series matching %s are stored at both %s and %s, pick one", query, rollup, b.Rollup)
+		}
+		buckets[path] = b
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	batch := opts.Batch
+	if batch <= 0 {
+		batch = len(paths)
+	}
+	step := int(rollup.Seconds())
+	span := EXPORT_CHUNK_POINTS * step
+	lower := from / step * step
+	for i := 0; i < len(paths); i += batch {
+		end := i + batch
+		if end > len(paths) {
+			end = len(paths)
+		}
+		for start := lower; start < to; start += span {
+			upper := start + span
+			if upper > to {
+				upper = to
+			}
+			chunk, err := s.exportChunk(paths[i:end], buckets, start, upper, opts)
+			if err == nil {
+				err = fn(chunk)
+			}
+			chunk.Release()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) exportBucket(path string, resolution time.Duration) (*schema.Bucket, error) {
+	buckets := s.GetBuckets(path)
+	if resolution == 0 {
+		return buckets[0], nil
+	}
+	for _, b := range buckets {
+		if b.Rollup == resolution {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("store: %s has no %s bucket", path, resolution)
+}
+
+// exportChunk reads from-to of paths, grouped the same way as GetMany
+func (s *Store) exportChunk(paths []string, buckets map[string]*schema.Bucket, from, to int, opts ExportOptions) (*ExportChunk, error) {
+	type group struct {
+		r     *schema.Range
+		agg   *aggregate.Rule
+		paths []string
+	}
+	groups := make(map[string]*group)
+	for _, path := range paths {
+		_, agg, err := s.readRule(path, ReadOptions{Method: opts.Method})
+		if err != nil {
+			return nil, err
+		}
+		// Drivers never fill the very last slot of a range,
+		// so read one past it
+		r := buckets[path].Range(from, to)
+		r = buckets[path].Range(r.Lower, r.Upper+r.Rollup)
+		key := fmt.Sprintf("%v %v", *r, agg.Method)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{r: r, agg: agg}
+			groups[key] = g
+		}
+		g.paths = append(g.paths, path)
+	}
+
+	chunk := &ExportChunk{Paths: paths, Data: make([]NullFloat64s, len(paths))}
+	index := make(map[string]int, len(paths))
+	for i, path := range paths {
+		index[path] = i
+	}
+	var err error
+	for _, g := range groups {
+		chunk.Lower, chunk.Rollup = g.r.Lower, g.r.Rollup
+		n := g.r.Len() - 1
+		s.readMany(g.paths, g.r, g.agg, func(res *Result) {
+			if res.Err != nil && err == nil {
+				err = res.Err
+			}
+			data := res.Data
+			if len(data) > n {
+				data[n:].Release()
+				data = data[:n]
+			}
+			for len(data) < n {
+				data = append(data, nil)
+			}
+			chunk.Data[index[res.Path]] = data
+		})
+	}
+	return chunk, err
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/metric"
+
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	s, driver := newMemoryStore(t, "1min:1d", "avg", "a.x", "a.y", "b.z")
+	bucket := s.GetBuckets("a.x")[0]
+	avg := s.aggregation.Match("a.x")
+	for _, p := range []struct {
+		path  string
+		time  uint32
+		value float64
+	}{
+		{"a.x", 6000, 1},
+		{"a.x", 6060, 2},
+		{"a.x", 6070, 4},
+		{"a.y", 6120, 5},
+		{"b.z", 6000, 9},
+	} {
+		point := metric.New()
+		point.SetPath(p.path)
+		point.SetTimestamp(p.time)
+		point.SetValue(p.value)
+		if err := driver.WriteToBucket(point, avg, bucket); err != nil {
+			t.Fatal(err)
+		}
+		point.Release()
+	}
+
+	var chunks []*ExportChunk
+	collect := func(c *ExportChunk) error {
+		cp := *c
+		cp.Data = make([]NullFloat64s, len(c.Data))
+		for i, data := range c.Data {
+			for _, v := range data {
+				if v == nil {
+					cp.Data[i] = append(cp.Data[i], nil)
+				} else {
+					cp.Data[i] = append(cp.Data[i], NewNullFloat64(v.Float64, v.Valid))
+				}
+			}
+		}
+		chunks = append(chunks, &cp)
+		return nil
+	}
+
+	if err := s.Export("a.*", 6000, 6300, ExportOptions{}, collect); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("Export wrote %d chunks, want 1", len(chunks))
+	}
+	c := chunks[0]
+	if c.Lower != 6000 || c.Rollup != 60 || len(c.Paths) != 2 || c.Paths[0] != "a.x" || c.Paths[1] != "a.y" {
+		t.Fatalf("Export chunk of %v from %d every %d", c.Paths, c.Lower, c.Rollup)
+	}
+	for i, want := range [][]interface{}{
+		{1.0, 3.0, nil, nil, nil},
+		{nil, nil, 5.0, nil, nil},
+	} {
+		if !sameValues(values(c.Data[i]), want) {
+			t.Errorf("Export %s = %v, want %v", c.Paths[i], values(c.Data[i]), want)
+		}
+		c.Data[i].Release()
+	}
+
+	// A batch of one series at a time
+	chunks = nil
+	if err := s.Export("*", 6000, 6300, ExportOptions{Batch: 1}, collect); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("Export in batches of 1 wrote %d chunks, want 3", len(chunks))
+	}
+	for i, want := range []string{"a.x", "a.y", "b.z"} {
+		if len(chunks[i].Paths) != 1 || chunks[i].Paths[0] != want {
+			t.Errorf("Export batch %d = %v, want [%s]", i, chunks[i].Paths, want)
+		}
+		chunks[i].Release()
+	}
+
+	// A method the series isn't aggregated by fails, rather than panics
+	max := aggregate.MAX
+	err := s.Export("a.*", 6000, 6300, ExportOptions{Method: &max}, func(c *ExportChunk) error {
+		t.Error("Export of a method that isn't stored wrote a chunk")
+		return nil
+	})
+	if err == nil {
+		t.Error("Export of a method that isn't stored succeeded")
+	}
+
+	// Nothing matching isn't an error
+	if err := s.Export("nothing.*", 6000, 6300, ExportOptions{}, collect); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Encoding of a chunk of points, as described in "Gorilla: A Fast,
+// Scalable, In-Memory Time Series Database". Timestamps are stored as
+// the delta of their delta from the previous point, and values as the
+// XOR with the previous value, both of which are mostly zero, or close
+// to it, for regular series.
+//
+// The number of points comes first as a uint32, followed by the bit
+// stream. That starts with the time of the first point as a raw 64 bit
+// header, since its delta from 0 is the whole timestamp, which doesn't
+// fit the widest delta of delta. Its value is encoded as if following
+// a value of 0.
+
+var errChunkCorrupt = errors.New("store: corrupt chunk")
+
+type chunkPoint struct {
+	time  uint32
+	value float64
+}
+
+type bitWriter struct {
+	buf   []byte
+	count uint8 // bits free in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.count == 0 {
+		w.buf = append(w.buf, 0)
+		w.count = 8
+	}
+	w.count--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.count
+	}
+}
+
+// writeBits writes the lowest n bits of u, most significant first
+func (w *bitWriter) writeBits(u uint64, n int) {
+	for n > 0 {
+		n--
+		w.writeBit(u>>uint(n)&1 == 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos int // in bits
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.buf)*8 {
+		return false, errChunkCorrupt
+	}
+	bit := r.buf[r.pos/8]>>uint(7-r.pos%8)&1 == 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var u uint64
+	for ; n > 0; n-- {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
+
+// Delta of delta encodings, by the prefix they're written with
+var dodBuckets = []struct {
+	prefix, prefixBits uint64
+	bits               int
+}{
+	{0x2, 2, 7},
+	{0x6, 3, 9},
+	{0xe, 4, 12},
+	{0xf, 4, 32},
+}
+
+type chunkEncoder struct {
+	w     bitWriter
+	count uint32
+
+	time, delta       int64
+	value             uint64
+	leading, trailing int
+}
+
+// Push appends a point, which must not be older than the previous one
+func (e *chunkEncoder) Push(time uint32, value float64) {
+	delta := int64(time) - e.time
+	dod := delta - e.delta
+	if e.count == 0 {
+		e.w.writeBits(uint64(time), 64)
+		delta = 0
+	} else if dod == 0 {
+		e.w.writeBit(false)
+	} else {
+		for _, b := range dodBuckets {
+			if b.bits == 32 || (dod >= -(1<<uint(b.bits-1)) && dod < 1<<uint(b.bits-1)) {
+				e.w.writeBits(b.prefix, int(b.prefixBits))
+				e.w.writeBits(uint64(dod), b.bits)
+				break
+			}
+		}
+	}
+	e.time, e.delta = int64(time), delta
+
+	v := math.Float64bits(value)
+	xor := v ^ e.value
+	if xor == 0 {
+		e.w.writeBit(false)
+	} else {
+		e.w.writeBit(true)
+		leading, trailing := bits.LeadingZeros64(xor), bits.TrailingZeros64(xor)
+		if leading > 31 {
+			// Has to fit in 5 bits
+			leading = 31
+		}
+		if e.count > 0 && leading >= e.leading && trailing >= e.trailing {
+			// Fits within the previous meaningful bits
+			e.w.writeBit(false)
+			e.w.writeBits(xor>>uint(e.trailing), 64-e.leading-e.trailing)
+		} else {
+			e.w.writeBit(true)
+			e.leading, e.trailing = leading, trailing
+			n := 64 - leading - trailing
+			e.w.writeBits(uint64(leading), 5)
+			// 64 meaningful bits don't fit in 6, but never
+			// happen along with leading zeros, so write it as 0
+			e.w.writeBits(uint64(n), 6)
+			e.w.writeBits(xor>>uint(trailing), n)
+		}
+	}
+	e.value = v
+	e.count++
+}
+
+func (e *chunkEncoder) Bytes() []byte {
+	buf := make([]byte, 4, 4+len(e.w.buf))
+	binary.BigEndian.PutUint32(buf, e.count)
+	return append(buf, e.w.buf...)
+}
+
+func encodeChunk(points []chunkPoint) []byte {
+	var e chunkEncoder
+	for _, p := range points {
+		e.Push(p.time, p.value)
+	}
+	return e.Bytes()
+}
+
+func decodeChunk(buf []byte) ([]chunkPoint, error) {
+	if len(buf) < 4 {
+		return nil, errChunkCorrupt
+	}
+	count := binary.BigEndian.Uint32(buf)
+	r := &bitReader{buf: buf[4:]}
+	points := make([]chunkPoint, 0, count)
+
+	var (
+		time, delta       int64
+		value             uint64
+		leading, trailing int
+	)
+	for i := uint32(0); i < count; i++ {
+		if i == 0 {
+			u, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			time = int64(u)
+		} else {
+			dod, err := readDod(r)
+			if err != nil {
+				return nil, err
+			}
+			delta += dod
+			time += delta
+		}
+
+		bit, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if bit {
+			if bit, err = r.readBit(); err != nil {
+				return nil, err
+			}
+			if bit {
+				l, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				n, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				if n == 0 {
+					n = 64
+				}
+				leading, trailing = int(l), 64-int(l)-int(n)
+			}
+			xor, err := r.readBits(64 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			value ^= xor << uint(trailing)
+		}
+		points = append(points, chunkPoint{uint32(time), math.Float64frombits(value)})
+	}
+	return points, nil
+}
+
+// readDod reads a delta of delta, in whichever encoding it was written
+func readDod(r *bitReader) (int64, error) {
+	bit, err := r.readBit()
+	if err != nil || !bit {
+		return 0, err
+	}
+	n := 0
+	for _, b := range dodBuckets[:3] {
+		if bit, err = r.readBit(); err != nil {
+			return 0, err
+		}
+		if !bit {
+			n = b.bits
+			break
+		}
+	}
+	if n == 0 {
+		n = 32
+	}
+	u, err := r.readBits(n)
+	if err != nil {
+		return 0, err
+	}
+	// Sign extend
+	return int64(u<<uint(64-n)) >> uint(64-n), nil
+}
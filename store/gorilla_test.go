@@ -0,0 +1,57 @@
+package store
+
+import (
+	"math"
+	"testing"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	// Points a minute apart from start, with values
+	regular := func(start uint32, values ...float64) []chunkPoint {
+		points := make([]chunkPoint, len(values))
+		for i, v := range values {
+			points[i] = chunkPoint{start + uint32(i*60), v}
+		}
+		return points
+	}
+
+	for _, tc := range []struct {
+		name   string
+		points []chunkPoint
+	}{
+		{"empty", nil},
+		{"single", regular(1500000000, 1.5)},
+		{"regular", regular(1500000000, 1, 2, 3, 4, 5, 6, 7, 8)},
+		{"constant", regular(1500000000, 42, 42, 42, 42)},
+		{"irregular", []chunkPoint{{1500000000, 1}, {1500000001, -1}, {1500000100, 0.1}, {1500086400, 1e300}, {1500086401, -0}}},
+		{"special values", regular(1500000000, math.Inf(1), math.Inf(-1), math.MaxFloat64, math.SmallestNonzeroFloat64, 0)},
+		// Past 2038, where the first timestamp no longer fits an int32
+		{"after 2038", regular(1<<31, 1, 2, 3)},
+		{"near the end of uint32", regular(math.MaxUint32-180, 1, 2, 3, 4)},
+		{"from zero", regular(0, 1, 2)},
+	} {
+		got, err := decodeChunk(encodeChunk(tc.points))
+		if err != nil {
+			t.Errorf("%s: decodeChunk: %s", tc.name, err)
+			continue
+		}
+		if len(got) != len(tc.points) {
+			t.Errorf("%s: decoded %d points, want %d", tc.name, len(got), len(tc.points))
+			continue
+		}
+		for i, p := range tc.points {
+			if got[i].time != p.time || math.Float64bits(got[i].value) != math.Float64bits(p.value) {
+				t.Errorf("%s: point %d = %v, want %v", tc.name, i, got[i], p)
+			}
+		}
+	}
+}
+
+func TestChunkCorrupt(t *testing.T) {
+	buf := encodeChunk([]chunkPoint{{1500000000, 1}, {1500000060, 2}})
+	for _, b := range [][]byte{nil, buf[:3], buf[:len(buf)-2]} {
+		if _, err := decodeChunk(b); err != errChunkCorrupt {
+			t.Errorf("decodeChunk(%v) error = %v, want %v", b, err, errChunkCorrupt)
+		}
+	}
+}
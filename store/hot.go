@@ -0,0 +1,159 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Roughly how much memory each point held takes up
+const HOT_POINT_SIZE = 16
+
+// Roughly how much memory each series held takes up besides its
+// points and path, for its list element, map entry and hotSeries
+const HOT_SERIES_SIZE = 128
+
+type hotPoint struct {
+	time  uint32
+	value float64
+}
+
+type hotSeries struct {
+	path   string
+	points []hotPoint
+	// Every point written from here on is held
+	since int
+}
+
+// hotWindow keeps the most recent raw points written for each series,
+// so reads of the last few minutes don't need to go to the Driver, and
+// see points that the Driver may not have made readable yet. Once more
+// than maxBytes are held, the least recently written series are dropped.
+// Points written by other processes are never seen, so with more than one
+// taking writes, reads of the window would miss theirs.
+type hotWindow struct {
+	window   int
+	maxBytes int64
+
+	bytes  int64
+	ll     *list.List
+	series map[string]*list.Element
+	mux    sync.Mutex
+}
+
+func newHotWindow(window time.Duration, budget int64) *hotWindow {
+	return &hotWindow{
+		window:   int(window.Seconds()),
+		maxBytes: budget,
+		ll:       list.New(),
+		series:   make(map[string]*list.Element),
+	}
+}
+
+func (h *hotWindow) Add(path string, time uint32, value float64, now int) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	var s *hotSeries
+	if ele, ok := h.series[path]; ok {
+		s = ele.Value.(*hotSeries)
+		h.ll.MoveToFront(ele)
+	} else {
+		// Points written before now never made it here
+		s = &hotSeries{path: path, since: now}
+		h.series[path] = h.ll.PushFront(s)
+		h.bytes += HOT_SERIES_SIZE + int64(len(path))
+	}
+	h.trim(s, now)
+	if int(time) < s.since {
+		return
+	}
+	// Kept in time order, so late points are trimmed like any other
+	i := sort.Search(len(s.points), func(i int) bool { return s.points[i].time > time })
+	s.points = append(s.points, hotPoint{})
+	copy(s.points[i+1:], s.points[i:])
+	s.points[i] = hotPoint{time, value}
+	h.bytes += HOT_POINT_SIZE
+	for h.bytes > h.maxBytes && h.ll.Len() > 0 {
+		h.drop(h.ll.Back())
+	}
+}
+
+// drop forgets the series held in ele
+func (h *hotWindow) drop(ele *list.Element) {
+	s := h.ll.Remove(ele).(*hotSeries)
+	delete(h.series, s.path)
+	h.bytes -= HOT_SERIES_SIZE + int64(len(s.path)) + int64(len(s.points))*HOT_POINT_SIZE
+}
+
+// Remove forgets everything held for path
+func (h *hotWindow) Remove(path string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if ele, ok := h.series[path]; ok {
+		h.drop(ele)
+	}
+}
+
+// trim drops points that have fallen out of the window, which
+// are all at the start, since points are kept in time order
+func (h *hotWindow) trim(s *hotSeries, now int) {
+	if now-h.window > s.since {
+		s.since = now - h.window
+	}
+	i := 0
+	for i < len(s.points) && int(s.points[i].time) < s.since {
+		i++
+	}
+	if i > 0 {
+		n := copy(s.points, s.points[i:])
+		s.points = s.points[:n]
+		h.bytes -= int64(i) * HOT_POINT_SIZE
+	}
+}
+
+// Get aggregates the points held for path into the slots of r,
+// returning where they start and a series with every slot from there
+// on filled in. Returns r.Upper and nil if nothing of r is held.
+func (h *hotWindow) Get(path string, r *schema.Range, method aggregate.Method, now int) (int, NullFloat64s) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	ele, ok := h.series[path]
+	if !ok {
+		return r.Upper, nil
+	}
+	s := ele.Value.(*hotSeries)
+	since := s.since
+	if now-h.window > since {
+		since = now - h.window
+	}
+	// Only slots we hold every point for
+	lower := (since + r.Rollup - 1) / r.Rollup * r.Rollup
+	if lower < r.Lower {
+		lower = r.Lower
+	}
+	if lower >= r.Upper {
+		return r.Upper, nil
+	}
+
+	n := r.Len()
+	acc := make([]accumulator, n)
+	for _, p := range s.points {
+		if int(p.time) < lower {
+			continue
+		}
+		if i := r.Index(int64(p.time)); i >= 0 && i < n {
+			acc[i].Add(p.value, method)
+		}
+	}
+	series := make(NullFloat64s, n)
+	for i := (lower - r.Lower) / r.Rollup; i < n; i++ {
+		if acc[i].count > 0 {
+			series[i] = NewNullFloat64(acc[i].Value(method), true)
+		}
+	}
+	return lower, series
+}
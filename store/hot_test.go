@@ -0,0 +1,55 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHotWindowOutOfOrder(t *testing.T) {
+	h := newHotWindow(5*time.Minute, 1<<20)
+	h.Add("a.x", 1020, 2, 960)
+	h.Add("a.x", 990, 3, 960)
+	h.Add("a.x", 960, 1, 960)
+
+	// The last point of a slot is the latest, not the last written
+	_, series := h.Get("a.x", schema.NewRange(960, 1080, 60), aggregate.LAST, 1000)
+	if !sameValues(values(series), []interface{}{3.0, 2.0}) {
+		t.Errorf("Get = %v, want [3 2]", values(series))
+	}
+	series.Release()
+
+	// Late points fall out of the window along with the rest
+	h.Add("a.x", 1080, 5, 1080)
+	h.Add("a.x", 1000, 6, 1080)
+	h.Add("a.x", 1330, 4, 1330)
+	s := h.series["a.x"].Value.(*hotSeries)
+	if len(s.points) != 2 || s.points[0].time != 1080 || s.points[1].time != 1330 {
+		t.Errorf("held %v after trimming, want 1080 and 1330", s.points)
+	}
+	if want := int64(HOT_SERIES_SIZE + len("a.x") + 2*HOT_POINT_SIZE); h.bytes != want {
+		t.Errorf("held %d bytes, want %d", h.bytes, want)
+	}
+}
+
+func TestHotWindowBudget(t *testing.T) {
+	long := strings.Repeat("x", 1000)
+	h := newHotWindow(5*time.Minute, 2*(HOT_SERIES_SIZE+HOT_POINT_SIZE)+1500)
+	// Paths count too, so the second long one doesn't fit
+	h.Add("a."+long, 1000, 1, 1000)
+	h.Add("b."+long, 1000, 1, 1000)
+	if _, ok := h.series["a."+long]; ok {
+		t.Error("the least recently written series was kept over budget")
+	}
+	if _, ok := h.series["b."+long]; !ok {
+		t.Error("the most recently written series was dropped")
+	}
+
+	h.Remove("b." + long)
+	if h.bytes != 0 || h.ll.Len() != 0 {
+		t.Errorf("held %d bytes of %d series after Remove", h.bytes, h.ll.Len())
+	}
+}
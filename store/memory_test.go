@@ -0,0 +1,278 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/index"
+	"github.com/mattrobenolt/mineshaft/metric"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type memoryKey struct {
+	path   string
+	rollup int
+}
+
+// memoryDriver keeps every slot in memory, for testing a Store
+// without Cassandra. Writes fail with err while it's set.
+type memoryDriver struct {
+	slots map[memoryKey]map[uint32]*accumulator
+	err   error
+	mux   sync.Mutex
+}
+
+func newMemoryDriver() *memoryDriver {
+	return &memoryDriver{slots: make(map[memoryKey]map[uint32]*accumulator)}
+}
+
+// Drivers opened from memory://name urls, by name, so that
+// tests can look inside the ones a TeeDriver opened
+var (
+	memoryDrivers   = make(map[string]*memoryDriver)
+	memoryDriversMu sync.Mutex
+)
+
+func init() {
+	Register("memory", func() Driver { return newMemoryDriver() })
+}
+
+func (d *memoryDriver) Init(u *url.URL) error {
+	memoryDriversMu.Lock()
+	memoryDrivers[u.Host] = d
+	memoryDriversMu.Unlock()
+	return nil
+}
+
+// value is what's stored for path in slot t of b
+func (d *memoryDriver) value(path string, t uint32, b *schema.Bucket, method aggregate.Method) (float64, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	acc, ok := d.slots[memoryKey{path, int(b.Rollup.Seconds())}][b.RoundDown(t)]
+	if !ok {
+		return 0, false
+	}
+	return acc.Value(method), true
+}
+
+func (d *memoryDriver) WriteToBucket(p *metric.Point, agg *aggregate.Rule, b *schema.Bucket) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	key := memoryKey{p.GetPath(), int(b.Rollup.Seconds())}
+	if d.slots[key] == nil {
+		d.slots[key] = make(map[uint32]*accumulator)
+	}
+	slot := b.RoundDown(p.GetTimestamp())
+	acc, ok := d.slots[key][slot]
+	if !ok {
+		acc = &accumulator{}
+		d.slots[key][slot] = acc
+	}
+	acc.Add(p.GetValue(), agg.Method)
+	return nil
+}
+
+func (d *memoryDriver) WriteBatchToBucket(path string, points metric.Points, agg *aggregate.Rule, b *schema.Bucket) []error {
+	errs := make([]error, len(points))
+	for i, p := range points {
+		errs[i] = d.WriteToBucket(p, agg, b)
+	}
+	return errs
+}
+
+func (d *memoryDriver) SetBucket(path string, slots map[uint32]*accumulator, agg *aggregate.Rule, b *schema.Bucket) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	key := memoryKey{path, int(b.Rollup.Seconds())}
+	if d.slots[key] == nil {
+		d.slots[key] = make(map[uint32]*accumulator)
+	}
+	for t, acc := range slots {
+		cp := *acc
+		d.slots[key][t] = &cp
+	}
+	return nil
+}
+
+// Get leaves the last slot of r empty, like every other Driver
+func (d *memoryDriver) Get(path string, r *schema.Range, agg *aggregate.Rule) (NullFloat64s, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	series := make(NullFloat64s, r.Len())
+	for t, acc := range d.slots[memoryKey{path, r.Rollup}] {
+		if i := r.Index(int64(t)); i >= 0 && i < len(series)-1 {
+			series[i] = NewNullFloat64(acc.Value(agg.Method), true)
+		}
+	}
+	return series, nil
+}
+
+func (d *memoryDriver) GetMany(paths []string, r *schema.Range, agg *aggregate.Rule, results chan<- *Result) {
+	for _, path := range paths {
+		data, err := d.Get(path, r, agg)
+		results <- &Result{path, r, data, err}
+	}
+}
+
+func (d *memoryDriver) Delete(path string, buckets []*schema.Bucket, agg *aggregate.Rule) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	for _, b := range buckets {
+		delete(d.slots, memoryKey{path, int(b.Rollup.Seconds())})
+	}
+	return nil
+}
+
+func (d *memoryDriver) Copy(from, to string, buckets []*schema.Bucket, agg *aggregate.Rule) error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	for _, b := range buckets {
+		rollup := int(b.Rollup.Seconds())
+		src := d.slots[memoryKey{from, rollup}]
+		if src == nil {
+			continue
+		}
+		dst := d.slots[memoryKey{to, rollup}]
+		if dst == nil {
+			dst = make(map[uint32]*accumulator)
+			d.slots[memoryKey{to, rollup}] = dst
+		}
+		for t, acc := range src {
+			if dst[t] == nil {
+				dst[t] = &accumulator{}
+			}
+			dst[t].Merge(*acc)
+		}
+	}
+	return nil
+}
+
+func (d *memoryDriver) Ping() error {
+	return nil
+}
+
+func (d *memoryDriver) Close() {}
+
+// memoryIndex holds a fixed set of leaves, with queries matched as globs
+type memoryIndex struct {
+	paths []string
+	mux   sync.Mutex
+}
+
+func (i *memoryIndex) Init(*url.URL) error {
+	return nil
+}
+
+func (i *memoryIndex) Update(path string) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	for _, p := range i.paths {
+		if p == path {
+			return nil
+		}
+	}
+	i.paths = append(i.paths, path)
+	return nil
+}
+
+func (i *memoryIndex) Delete(path string) ([]string, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	for j, p := range i.paths {
+		if p == path {
+			i.paths = append(i.paths[:j], i.paths[j+1:]...)
+			return []string{path}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (i *memoryIndex) GetChildren(path string) ([]*index.Path, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	var children []*index.Path
+	seen := make(map[string]bool)
+	for _, p := range i.paths {
+		if !strings.HasPrefix(p, path+".") {
+			continue
+		}
+		key, leaf := p, true
+		if end := strings.Index(p[len(path)+1:], "."); end > -1 {
+			key, leaf = p[:len(path)+1+end], false
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if leaf {
+			children = append(children, index.NewLeaf(key))
+		} else {
+			children = append(children, index.NewBranch(key))
+		}
+	}
+	return children, nil
+}
+
+func (i *memoryIndex) Query(query string) ([]*index.Path, error) {
+	return i.QueryAll(query)
+}
+
+func (i *memoryIndex) QueryAll(query string) ([]*index.Path, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	var found []*index.Path
+	for _, p := range i.paths {
+		if ok, _ := filepath.Match(query, p); ok {
+			found = append(found, index.NewLeaf(p))
+		}
+	}
+	return found, nil
+}
+
+func (i *memoryIndex) Close() {}
+
+func (i *memoryIndex) Ping() error {
+	return nil
+}
+
+var (
+	memoryIndexes   int
+	memoryIndexesMu sync.Mutex
+)
+
+// newMemoryStore is a Store over a memoryDriver, with every series kept
+// at retentions and aggregated by methods, and paths in its index
+func newMemoryStore(t *testing.T, retentions, methods string, paths ...string) (*Store, *memoryDriver) {
+	memoryIndexesMu.Lock()
+	memoryIndexes++
+	scheme := fmt.Sprintf("memorytest%d", memoryIndexes)
+	memoryIndexesMu.Unlock()
+	index.Register(scheme, &memoryIndex{paths: paths})
+	u, err := url.Parse(scheme + "://")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sch := &schema.Schema{}
+	sch.AddDefaultRule(retentions)
+	agg := &aggregate.Aggregation{}
+	agg.AddDefaultRule(methods, 0)
+
+	driver := newMemoryDriver()
+	s := New(driver)
+	s.SetSchema(sch)
+	s.SetAggregation(agg)
+	s.SetIndexer(index.NewFromConnection(u))
+	return s, driver
+}
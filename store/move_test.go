@@ -0,0 +1,52 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/metric"
+
+	"testing"
+)
+
+func TestMove(t *testing.T) {
+	s, driver := newMemoryStore(t, "1min:1d", "sum", "a.x", "a.b.x")
+	bucket := s.GetBuckets("a.x")[0]
+	sum := s.aggregation.Match("a.x")
+	for _, path := range []string{"a.x", "a.b.x"} {
+		p := metric.New()
+		p.SetPath(path)
+		p.SetTimestamp(6000)
+		p.SetValue(1)
+		if err := driver.WriteToBucket(p, sum, bucket); err != nil {
+			t.Fatal(err)
+		}
+		p.Release()
+	}
+	opts := MoveOptions{Merge: true, DeleteSource: true}
+
+	// Each of these would copy a series onto itself, then delete it
+	if _, err := s.Move("", "a.x", "a.x", opts); err == nil {
+		t.Error("Move onto itself succeeded")
+	}
+	if _, err := s.Move("a.*", "a", "a.b", opts); err == nil {
+		t.Error("Move onto another series being moved succeeded")
+	}
+	for _, path := range []string{"a.x", "a.b.x"} {
+		if v, ok := driver.value(path, 6000, bucket, aggregate.SUM); !ok || v != 1 {
+			t.Errorf("%s = %v after a rejected Move, want 1", path, v)
+		}
+	}
+
+	result, err := s.Move("", "a.x", "c.x", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Moved["a.x"] != "c.x" {
+		t.Errorf("Move moved %v", result.Moved)
+	}
+	if v, ok := driver.value("c.x", 6000, bucket, aggregate.SUM); !ok || v != 1 {
+		t.Errorf("c.x = %v after Move, want 1", v)
+	}
+	if _, ok := driver.value("a.x", 6000, bucket, aggregate.SUM); ok {
+		t.Error("a.x is still stored after Move")
+	}
+}
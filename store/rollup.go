@@ -0,0 +1,383 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	log "github.com/mattrobenolt/mineshaft/logging"
+	"github.com/mattrobenolt/mineshaft/metric"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long after a slot has ended before it's rolled up, so that
+// points which arrive late, or sit in a batch, are included
+const ROLLUP_DELAY = 2 * time.Minute
+
+// Most slots of a bucket rolled up for a series in one pass,
+// so catching up after downtime is spread over several
+const ROLLUP_MAX_SLOTS = 1000
+
+// Whether a method can be derived from the slots of a finer bucket.
+// Counts and percentiles can't, so they're still written to every
+// bucket on ingest.
+func downsampled(method aggregate.Method) bool {
+	switch method {
+	case aggregate.MIN, aggregate.MAX, aggregate.SUM, aggregate.AVG, aggregate.LAST, aggregate.FIRST:
+		return true
+	}
+	return false
+}
+
+// rollup derives the coarser buckets of each series from the next finer
+// one once their slots have closed, so ingest only writes the finest.
+//
+// Each slot of a coarser bucket is rolled up once, so points arriving more
+// than ROLLUP_DELAY late only make it into the finest bucket. How far each
+// method of each series has been rolled up is checkpointed to a local file
+// after every pass, so rollups pick up where they left off after a
+// restart. Slots are set, rather than added to, on Drivers that can
+// backfill, so those rolled up after the last checkpoint before a crash
+// are simply set again when it restarts. Other Drivers count them twice.
+//
+// Nothing coordinates rollups between processes, so only a single process
+// may downsample, or every slot is counted once by each of them.
+type rollup struct {
+	store    *Store
+	interval time.Duration
+	file     string
+
+	// Path to the method and rollup of each bucket, see markKey, to
+	// the start of the first slot that hasn't been rolled up yet
+	marks map[string]map[string]uint32
+	// Timestamp of the newest point seen for each path
+	seen map[string]uint32
+	mux  sync.Mutex
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newRollup(s *Store, interval time.Duration, file string) (*rollup, error) {
+	r := &rollup{
+		store:    s,
+		interval: interval,
+		file:     file,
+		marks:    make(map[string]map[string]uint32),
+		seen:     make(map[string]uint32),
+		done:     make(chan struct{}),
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(buf) > 0 {
+		if err = json.Unmarshal(buf, &r.marks); err != nil {
+			return nil, err
+		}
+	}
+	// Whatever was seen before the restart is unknown, so
+	// assume every series is still being written to
+	now := uint32(time.Now().Unix())
+	for path := range r.marks {
+		r.seen[path] = now
+	}
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+// Each method of each bucket is checkpointed on its own, so one
+// failing doesn't roll the others up again
+func markKey(method aggregate.Method, b *schema.Bucket) string {
+	return fmt.Sprintf("%v:%d", method, int(b.Rollup.Seconds()))
+}
+
+// Track records that a point was written for path, so that
+// its coarser buckets are rolled up from then on.
+func (r *rollup) Track(path string, timestamp uint32, buckets []*schema.Bucket, agg *aggregate.Rule) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if timestamp > r.seen[path] {
+		r.seen[path] = timestamp
+	}
+	if _, ok := r.marks[path]; ok {
+		return
+	}
+	// Never start before what could already have been rolled up,
+	// in case this series was tracked, and forgotten, before
+	closed := uint32(time.Now().Add(-ROLLUP_DELAY).Unix())
+	marks := make(map[string]uint32)
+	for _, b := range buckets[1:] {
+		start := b.RoundDown(timestamp)
+		if earliest := b.RoundDown(closed); start < earliest {
+			start = earliest
+		}
+		for _, method := range agg.Methods {
+			if downsampled(method) {
+				marks[markKey(method, b)] = start
+			}
+		}
+	}
+	r.marks[path] = marks
+}
+
+// Mark is where rolling method of path up into b picks up from
+func (r *rollup) Mark(path string, method aggregate.Method, b *schema.Bucket) uint32 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if mark, ok := r.marks[path][markKey(method, b)]; ok {
+		return mark
+	}
+	// Where tracking it would start
+	return b.RoundDown(uint32(time.Now().Add(-ROLLUP_DELAY).Unix()))
+}
+
+// Forget stops rolling up path, e.g. once it's been deleted
+func (r *rollup) Forget(path string) {
+	r.mux.Lock()
+	delete(r.marks, path)
+	delete(r.seen, path)
+	r.mux.Unlock()
+}
+
+func (r *rollup) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.pass()
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// pass rolls up every closed slot of every tracked series
+func (r *rollup) pass() {
+	start := time.Now()
+	closed := uint32(start.Add(-ROLLUP_DELAY).Unix())
+
+	r.mux.Lock()
+	paths := make([]string, 0, len(r.marks))
+	for path := range r.marks {
+		paths = append(paths, path)
+	}
+	r.mux.Unlock()
+
+	var slots, failed int
+	for _, path := range paths {
+		n, err := r.series(path, closed)
+		slots += n
+		if err != nil {
+			log.Println("store/rollup:", path, err)
+			failed++
+		}
+	}
+	if err := r.save(); err != nil {
+		log.Println("store/rollup: checkpoint failed:", err)
+	}
+	log.Println("store/rollup: rolled up", slots, "slots of", len(paths), "series,", failed, "failed, in", time.Now().Sub(start))
+}
+
+// series rolls up a single path, coarser buckets after finer ones, and
+// returns how many slots it wrote. A series is forgotten once all of its
+// points have been rolled up.
+func (r *rollup) series(path string, closed uint32) (int, error) {
+	buckets := r.store.GetBuckets(path)
+	agg := r.store.aggregation.Match(path)
+
+	r.mux.Lock()
+	marks := make(map[string]uint32, len(r.marks[path]))
+	for k, v := range r.marks[path] {
+		marks[k] = v
+	}
+	seen := r.seen[path]
+	r.mux.Unlock()
+
+	written := 0
+	done := true
+	var err error
+	for _, method := range agg.Methods {
+		if !downsampled(method) {
+			continue
+		}
+		rule := agg.For(method)
+		for i := 1; i < len(buckets); i++ {
+			src, b := buckets[i-1], buckets[i]
+			key := markKey(method, b)
+			from, ok := marks[key]
+			if !ok {
+				// Added to the schema since this series was tracked
+				from = b.RoundDown(closed)
+			}
+			to := b.RoundDown(closed)
+			if i > 1 {
+				// Can't get ahead of the bucket it's derived from,
+				// which stays put when rolling it up failed
+				if srcMark := marks[markKey(method, src)]; srcMark < to {
+					to = b.RoundDown(srcMark)
+				}
+			}
+			if max := from + uint32(ROLLUP_MAX_SLOTS*int(b.Rollup.Seconds())); to > max {
+				to = max
+			}
+			if to > from {
+				n, slotsErr := r.slots(path, rule, src, b, int(from), int(to))
+				if slotsErr != nil {
+					if err == nil {
+						err = slotsErr
+					}
+					done = false
+					continue
+				}
+				written += n
+				marks[key] = to
+			}
+			if to <= seen {
+				done = false
+			}
+		}
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.marks[path]; !ok {
+		// Deleted while we were at it
+		return written, err
+	}
+	if done && err == nil && r.seen[path] == seen {
+		delete(r.marks, path)
+		delete(r.seen, path)
+	} else {
+		r.marks[path] = marks
+	}
+	return written, err
+}
+
+// slots derives the slots of b between from and to from those of src
+func (r *rollup) slots(path string, agg *aggregate.Rule, src, b *schema.Bucket, from, to int) (int, error) {
+	driver := r.store.driver
+	stored := storagePath(path, agg)
+	in := src.Range(from, to)
+	// Drivers never fill the very last slot of a range
+	in.Upper += in.Rollup
+	data, err := driver.Get(stored, in, agg)
+	defer data.Release()
+	if err != nil {
+		return 0, err
+	}
+
+	out := b.Range(from, to)
+	if agg.Method == aggregate.AVG {
+		if n, ok, err := r.weighted(stored, data, in, out, agg, b); ok {
+			return n, err
+		}
+	}
+	values := Consolidate(data, in, out, agg.Method, 0)
+	defer values.Release()
+	if bf, ok := driver.(backfiller); ok {
+		slots := make(map[uint32]*accumulator)
+		for i, v := range values {
+			if v != nil && v.Valid {
+				acc := storedAccumulator(v.Float64, 1)
+				slots[uint32(out.Lower+i*out.Rollup)] = &acc
+			}
+		}
+		if len(slots) == 0 {
+			return 0, nil
+		}
+		return len(slots), bf.SetBucket(stored, slots, agg, b)
+	}
+	points := make(metric.Points, 0, len(values))
+	for i, v := range values {
+		if v == nil || !v.Valid {
+			continue
+		}
+		p := metric.New()
+		p.SetPath(stored)
+		p.SetValue(v.Float64)
+		p.SetTimestamp(uint32(out.Lower + i*out.Rollup))
+		points = append(points, p)
+	}
+	defer points.Release()
+	if len(points) == 0 {
+		return 0, nil
+	}
+	for _, err := range driver.WriteBatchToBucket(stored, points, agg, b) {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(points), nil
+}
+
+// weighted rolls up the AVG series stored under path along with how many
+// points went into each slot, so coarser slots are the average of every
+// point, and keep the count that xFilesFactor is checked against. ok is
+// false for Drivers that can't count samples or backfill.
+func (r *rollup) weighted(path string, data NullFloat64s, in, out *schema.Range, agg *aggregate.Rule, b *schema.Bucket) (n int, ok bool, err error) {
+	smp, isSampler := r.store.driver.(sampler)
+	bf, isBackfiller := r.store.driver.(backfiller)
+	if !isSampler || !isBackfiller {
+		return 0, false, nil
+	}
+	counts, err := smp.GetSamples(path, in)
+	defer counts.Release()
+	if err != nil {
+		return 0, true, err
+	}
+
+	slots := make(map[uint32]*accumulator)
+	for i, v := range data {
+		if v == nil || !v.Valid || i >= len(counts) || counts[i] == nil || !counts[i].Valid {
+			continue
+		}
+		j := out.Index(int64(in.Lower + i*in.Rollup))
+		if j < 0 || j >= out.Len() {
+			continue
+		}
+		slot := uint32(out.Lower + j*out.Rollup)
+		acc, ok := slots[slot]
+		if !ok {
+			acc = &accumulator{}
+			slots[slot] = acc
+		}
+		acc.count += int(counts[i].Float64)
+		acc.sum += v.Float64 * counts[i].Float64
+	}
+	if len(slots) == 0 {
+		return 0, true, nil
+	}
+	return len(slots), true, bf.SetBucket(path, slots, agg, b)
+}
+
+// save checkpoints how far every series has been rolled up
+func (r *rollup) save() error {
+	r.mux.Lock()
+	buf, err := json.Marshal(r.marks)
+	r.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := r.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.file)
+}
+
+// Close stops rolling up, and checkpoints one last time
+func (r *rollup) Close() {
+	close(r.done)
+	r.wg.Wait()
+	if err := r.save(); err != nil {
+		log.Println("store/rollup: checkpoint failed:", err)
+	}
+}
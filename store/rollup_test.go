@@ -0,0 +1,40 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/metric"
+
+	"testing"
+)
+
+func TestRollupReplay(t *testing.T) {
+	s, driver := newMemoryStore(t, "1min:1d,10min:1d", "sum")
+	buckets := s.GetBuckets("a.x")
+	sum := s.aggregation.Match("a.x")
+	for i := 0; i < 10; i++ {
+		p := metric.New()
+		p.SetPath("a.x")
+		p.SetTimestamp(uint32(6000 + i*60))
+		p.SetValue(1)
+		if err := driver.WriteToBucket(p, sum, buckets[0]); err != nil {
+			t.Fatal(err)
+		}
+		p.Release()
+	}
+
+	// Rolling up the same slots again, as after a crash
+	// before the checkpoint, leaves them as they were
+	r := &rollup{store: s}
+	for i := 0; i < 2; i++ {
+		n, err := r.slots("a.x", sum, buckets[0], buckets[1], 6000, 6600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("pass %d rolled up %d slots, want 1", i, n)
+		}
+		if v, _ := driver.value("a.x", 6000, buckets[1], aggregate.SUM); v != 10 {
+			t.Errorf("pass %d rolled up a sum of %v, want 10", i, v)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	"github.com/mattrobenolt/mineshaft/metric"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Router sends each path to the Driver of the first route whose pattern
+// matches it, or to the default Driver when none do, so that some
+// namespaces can be kept in a different store than the rest.
+type Router struct {
+	routes   []*route
+	fallback Driver
+}
+
+type route struct {
+	name    string
+	pattern *regexp.Regexp
+	driver  Driver
+}
+
+func NewRouter(fallback Driver) *Router {
+	return &Router{fallback: fallback}
+}
+
+// AddRoute sends paths matching pattern to driver. Routes are
+// matched in the order they're added.
+func (r *Router) AddRoute(name, pattern string, driver Driver) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("store/router: %s: %s", name, err)
+	}
+	r.routes = append(r.routes, &route{name, re, driver})
+	return nil
+}
+
+// Init is a no-op, routers are put together with NewRouter and AddRoute
+func (r *Router) Init(*url.URL) error {
+	return nil
+}
+
+// driverFor routes on the path of the series, without
+// the :method suffix that other methods are stored under
+func (r *Router) driverFor(path string) Driver {
+	path = seriesPath(path)
+	for _, route := range r.routes {
+		if route.pattern.MatchString(path) {
+			return route.driver
+		}
+	}
+	return r.fallback
+}
+
+// drivers lists every Driver once, along with its name,
+// however many routes share it
+func (r *Router) drivers() ([]string, []Driver) {
+	names := []string{"default"}
+	drivers := []Driver{r.fallback}
+	seen := map[Driver]bool{r.fallback: true}
+	for _, route := range r.routes {
+		if seen[route.driver] {
+			continue
+		}
+		seen[route.driver] = true
+		names = append(names, route.name)
+		drivers = append(drivers, route.driver)
+	}
+	return names, drivers
+}
+
+func (r *Router) WriteToBucket(p *metric.Point, agg *aggregate.Rule, b *schema.Bucket) error {
+	return r.driverFor(p.GetPath()).WriteToBucket(p, agg, b)
+}
+
+func (r *Router) WriteBatchToBucket(path string, points metric.Points, agg *aggregate.Rule, b *schema.Bucket) []error {
+	return r.driverFor(path).WriteBatchToBucket(path, points, agg, b)
+}
+
+func (r *Router) SetBucket(path string, slots map[uint32]*accumulator, agg *aggregate.Rule, b *schema.Bucket) error {
+	driver := r.driverFor(path)
+	bf, ok := driver.(backfiller)
+	if !ok {
+		return fmt.Errorf("store: %T can't backfill", driver)
+	}
+	return bf.SetBucket(path, slots, agg, b)
+}
+
+func (r *Router) Get(path string, rng *schema.Range, agg *aggregate.Rule) (NullFloat64s, error) {
+	return r.driverFor(path).Get(path, rng, agg)
+}
+
+func (r *Router) GetSamples(path string, rng *schema.Range) (NullFloat64s, error) {
+	driver := r.driverFor(path)
+	smp, ok := driver.(sampler)
+	if !ok {
+		return nil, fmt.Errorf("store: %T doesn't count samples", driver)
+	}
+	return smp.GetSamples(path, rng)
+}
+
+// GetMany splits paths up by Driver, and reads from each at once
+func (r *Router) GetMany(paths []string, rng *schema.Range, agg *aggregate.Rule, results chan<- *Result) {
+	var order []Driver
+	byDriver := make(map[Driver][]string)
+	for _, path := range paths {
+		d := r.driverFor(path)
+		if _, ok := byDriver[d]; !ok {
+			order = append(order, d)
+		}
+		byDriver[d] = append(byDriver[d], path)
+	}
+	var wg sync.WaitGroup
+	for _, d := range order {
+		wg.Add(1)
+		go func(d Driver, paths []string) {
+			d.GetMany(paths, rng, agg, results)
+			wg.Done()
+		}(d, byDriver[d])
+	}
+	wg.Wait()
+}
+
+func (r *Router) Delete(path string, buckets []*schema.Bucket, agg *aggregate.Rule) error {
+	return r.driverFor(path).Delete(path, buckets, agg)
+}
+
+// Copy only works within a single Driver
+func (r *Router) Copy(from, to string, buckets []*schema.Bucket, agg *aggregate.Rule) error {
+	d := r.driverFor(from)
+	if r.driverFor(to) != d {
+		return fmt.Errorf("store/router: %s and %s are in different stores", from, to)
+	}
+	return d.Copy(from, to, buckets, agg)
+}
+
+// Ping checks every Driver, failing if any of them do
+func (r *Router) Ping() error {
+	names, drivers := r.drivers()
+	var failed []string
+	for i, d := range drivers {
+		if err := d.Ping(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", names[i], err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("store/router: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// RetentionStats adds up what every Driver that reports it has reclaimed
+func (r *Router) RetentionStats() (RetentionStats, bool) {
+	var total RetentionStats
+	found := false
+	_, drivers := r.drivers()
+	for _, d := range drivers {
+		reporter, ok := d.(RetentionReporter)
+		if !ok {
+			continue
+		}
+		stats, ok := reporter.RetentionStats()
+		if !ok {
+			continue
+		}
+		found = true
+		total.Sweeps += stats.Sweeps
+		total.Partitions += stats.Partitions
+		total.Series += stats.Series
+		total.Rows += stats.Rows
+		if stats.LastSweep.After(total.LastSweep) {
+			total.LastSweep = stats.LastSweep
+		}
+		if total.LastError == "" {
+			total.LastError = stats.LastError
+		}
+	}
+	return total, found
+}
+
+// ReportWriteErrors passes report on to every Driver that writes later
+func (r *Router) ReportWriteErrors(report func(*WriteError)) {
+	_, drivers := r.drivers()
+	for _, d := range drivers {
+		if w, ok := d.(asyncWriter); ok {
+			w.ReportWriteErrors(report)
+		}
+	}
+}
+
+func (r *Router) Close() {
+	_, drivers := r.drivers()
+	for _, d := range drivers {
+		d.Close()
+	}
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"testing"
+)
+
+func TestRouterDriverFor(t *testing.T) {
+	// Routers are Drivers too, so empty ones tell the routes apart
+	fallback, servers, counts, odd := NewRouter(nil), NewRouter(nil), NewRouter(nil), NewRouter(nil)
+	r := NewRouter(fallback)
+	for _, route := range []struct {
+		name, pattern string
+		driver        Driver
+	}{
+		{"servers", `^servers\.`, servers},
+		{"counts", `\.count$`, counts},
+		{"odd", `^odd:name$`, odd},
+	} {
+		if err := r.AddRoute(route.name, route.pattern, route.driver); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := map[Driver]string{fallback: "default", servers: "servers", counts: "counts", odd: "odd"}
+	for _, tc := range []struct {
+		path string
+		want Driver
+	}{
+		{"servers.a.cpu", servers},
+		{"servers.a.cpu:max", servers},
+		{"servers.a.cpu:p99", servers},
+		{"servers.a.cpu:median", servers},
+		{"requests.count", counts},
+		// The suffix is stripped before anchoring at the end
+		{"requests.count:sum", counts},
+		// Earlier routes win
+		{"servers.requests.count", servers},
+		// Not a method, so it's part of the path
+		{"odd:name", odd},
+		{"requests.count:bogus", fallback},
+		{"other.path", fallback},
+		{"other.path:min", fallback},
+	} {
+		if got := r.driverFor(tc.path); got != tc.want {
+			t.Errorf("driverFor(%q) = %s, want %s", tc.path, names[got], names[tc.want])
+		}
+	}
+}
+
+func TestRouterSharedDriver(t *testing.T) {
+	fallback, cheap := NewRouter(nil), NewRouter(nil)
+	r := NewRouter(fallback)
+	for _, pattern := range []string{`^deploy\.`, `^puppet\.`} {
+		if err := r.AddRoute("cheap", pattern, cheap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.driverFor("puppet.reports") != cheap {
+		t.Error("the second route to a store wasn't used")
+	}
+	// Otherwise it would be closed twice
+	if names, drivers := r.drivers(); len(drivers) != 2 {
+		t.Errorf("drivers() = %v, want default and cheap once", names)
+	}
+}
+
+func TestRouterBadPattern(t *testing.T) {
+	if err := NewRouter(nil).AddRoute("bad", `(`, nil); err == nil {
+		t.Error("AddRoute with a bad pattern succeeded")
+	}
+}
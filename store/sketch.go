@@ -0,0 +1,94 @@
+package store
+
+import (
+	"math"
+	"sort"
+)
+
+// Relative accuracy of percentiles
+const SKETCH_ACCURACY = 0.01
+
+var (
+	sketchGamma    = (1 + SKETCH_ACCURACY) / (1 - SKETCH_ACCURACY)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// The bin zero is counted in. Positive values are in even bins, and
+// negative values in odd ones, so neither can end up here.
+const SKETCH_ZERO_BIN = math.MinInt32
+
+// sketch is a DDSketch, counting values in bins that grow exponentially,
+// so that any percentile is within SKETCH_ACCURACY of the real value.
+// Since a bin is only ever counted, sketches merge by adding their
+// counts, which lets drivers store each bin in a counter.
+type sketch struct {
+	bins  map[int32]uint64
+	count uint64
+}
+
+func newSketch() *sketch {
+	return &sketch{bins: make(map[int32]uint64)}
+}
+
+func sketchBin(v float64) int32 {
+	if v == 0 {
+		return SKETCH_ZERO_BIN
+	}
+	k := int32(math.Ceil(math.Log(math.Abs(v)) / sketchLogGamma))
+	if v < 0 {
+		return 2*k + 1
+	}
+	return 2 * k
+}
+
+// sketchValue is the value a bin stands for
+func sketchValue(bin int32) float64 {
+	if bin == SKETCH_ZERO_BIN {
+		return 0
+	}
+	v := 2 * math.Pow(sketchGamma, float64(bin>>1)) / (sketchGamma + 1)
+	if bin&1 == 1 {
+		return -v
+	}
+	return v
+}
+
+func (s *sketch) Add(v float64) {
+	s.AddBin(sketchBin(v), 1)
+}
+
+func (s *sketch) AddBin(bin int32, count uint64) {
+	s.bins[bin] += count
+	s.count += count
+}
+
+func (s *sketch) Merge(o *sketch) {
+	for bin, count := range o.bins {
+		s.AddBin(bin, count)
+	}
+}
+
+// Quantile returns the value below which q, between 0 and 1, of
+// all values fall
+func (s *sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return math.NaN()
+	}
+	values := make([]float64, 0, len(s.bins))
+	counts := make(map[float64]uint64, len(s.bins))
+	for bin, count := range s.bins {
+		v := sketchValue(bin)
+		values = append(values, v)
+		counts[v] = count
+	}
+	sort.Float64s(values)
+	rank := uint64(q * float64(s.count-1))
+	var seen uint64
+	for _, v := range values {
+		seen += counts[v]
+		if seen > rank {
+			return v
+		}
+	}
+	return values[len(values)-1]
+}
@@ -0,0 +1,58 @@
+package store
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSketchQuantile(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, tc := range []struct {
+		name   string
+		sample func() float64
+	}{
+		{"uniform", func() float64 { return rng.Float64() * 1000 }},
+		{"exponential", func() float64 { return rng.ExpFloat64() * 50 }},
+		{"negative", func() float64 { return -1 - rng.Float64()*100 }},
+		{"mixed", func() float64 { return rng.NormFloat64() * 100 }},
+	} {
+		s := newSketch()
+		values := make([]float64, 10000)
+		for i := range values {
+			values[i] = tc.sample()
+			s.Add(values[i])
+		}
+		sort.Float64s(values)
+		for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+			want := values[int(q*float64(len(values)-1))]
+			got := s.Quantile(q)
+			if math.Abs(got-want) > SKETCH_ACCURACY*math.Abs(want)+1e-9 {
+				t.Errorf("%s: quantile %v = %v, want %v within %v", tc.name, q, got, want, SKETCH_ACCURACY)
+			}
+		}
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	a, b, all := newSketch(), newSketch(), newSketch()
+	for i := 1; i <= 100; i++ {
+		v := float64(i)
+		all.Add(v)
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+	}
+	a.Merge(b)
+	for _, q := range []float64{0, 0.25, 0.5, 0.75, 1} {
+		if got, want := a.Quantile(q), all.Quantile(q); got != want {
+			t.Errorf("merged quantile %v = %v, want %v", q, got, want)
+		}
+	}
+	if !math.IsNaN(newSketch().Quantile(0.5)) {
+		t.Error("empty sketch should have no quantiles")
+	}
+}
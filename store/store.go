@@ -8,7 +8,9 @@ import (
 	"github.com/mattrobenolt/mineshaft/schema"
 
 	"encoding/json"
+	"fmt"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,10 +20,26 @@ type Store struct {
 	schema      *schema.Schema
 	aggregation *aggregate.Aggregation
 	index       *index.Store
+	batcher     *batcher
+	cache       *Cache
+	hot         *hotWindow
+	rollup      *rollup
+	dedupe      *deduper
+	errors      writeErrors
 }
 
+// Set writes a point for every method and bucket of its series. Without
+// batching, the first error the Driver returned is returned, otherwise
+// they can only be seen through SetWriteErrors and WriteStats.
 func (s *Store) Set(p *metric.Point) error {
 	var wg sync.WaitGroup
+	var firstErr error
+	var errMux sync.Mutex
+
+	if s.dedupe != nil && s.dedupe.Seen(p, time.Now()) {
+		// Already written, most likely resent by a client
+		return nil
+	}
 
 	buckets := s.GetBuckets(p.GetPath())
 	agg := s.aggregation.Match(p.GetPath())
@@ -37,30 +55,549 @@ func (s *Store) Set(p *metric.Point) error {
 		s.index.Update(p.GetPath())
 		wg.Done()
 	}()
-	for _, bucket := range buckets {
-		wg.Add(1)
-		go func(bucket *schema.Bucket) {
-			err := s.driver.WriteToBucket(p, agg, bucket)
-			if err != nil {
-				log.Println("store/store:", p, agg, bucket, err)
+	if s.hot != nil {
+		s.hot.Add(p.GetPath(), p.GetTimestamp(), p.GetValue(), int(time.Now().Unix()))
+	}
+	// Every method is written as a series of its own
+	for _, method := range agg.Methods {
+		rule := agg.For(method)
+		path := storagePath(p.GetPath(), rule)
+		buckets := buckets
+		if s.rollup != nil && downsampled(method) {
+			// The rest are rolled up from the finest later on
+			buckets = buckets[:1]
+		}
+		if s.batcher != nil {
+			for _, bucket := range buckets {
+				s.batcher.Add(path, p, rule, bucket)
 			}
-			wg.Done()
-		}(bucket)
+			continue
+		}
+		point := p
+		if path != p.GetPath() {
+			point = metric.New()
+			point.SetPath(path)
+			point.SetValue(p.GetValue())
+			point.SetTimestamp(p.GetTimestamp())
+			defer point.Release()
+		}
+		for _, bucket := range buckets {
+			wg.Add(1)
+			go func(bucket *schema.Bucket) {
+				err := s.driver.WriteToBucket(point, rule, bucket)
+				if err != nil {
+					log.Println("store/store:", point, rule, bucket, err)
+					s.failed(newWriteError(point, err))
+					errMux.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMux.Unlock()
+				}
+				wg.Done()
+			}(bucket)
+		}
+	}
+
+	if s.rollup != nil && len(buckets) > 1 {
+		s.rollup.Track(p.GetPath(), p.GetTimestamp(), buckets, agg)
 	}
 
 	wg.Wait()
-	return nil
+	return firstErr
 }
 
-func (s *Store) GetRange(path string, from, to int) *schema.Range {
-	return s.schema.GetRange(path, from, to)
+// storagePath is where a method of a series is stored. The first
+// method is stored under the path itself, any others under path:method.
+func storagePath(path string, agg *aggregate.Rule) string {
+	if agg.Primary() {
+		return path
+	}
+	return path + ":" + agg.Method.String()
+}
+
+// seriesPath is the path of the series stored under path,
+// without the :method suffix of anything but the first method
+func seriesPath(path string) string {
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		if _, err := aggregate.ParseMethod(path[i+1:]); err == nil {
+			return path[:i]
+		}
+	}
+	return path
 }
 
-func (s *Store) Get(path string, from, to int) (*schema.Range, NullFloat64s) {
-	r := s.GetRange(path, from, to)
+// readRule splits a method off the end of path, as in path:max, and
+// returns the path along with its rule narrowed down to that method,
+// or opts.Method, or the first method of the series.
+func (s *Store) readRule(path string, opts ReadOptions) (string, *aggregate.Rule, error) {
+	var method *aggregate.Method
+	if i := strings.LastIndex(path, ":"); i >= 0 {
+		m, err := aggregate.ParseMethod(path[i+1:])
+		if err != nil {
+			return "", nil, err
+		}
+		path, method = path[:i], &m
+	} else if opts.Method != nil {
+		method = opts.Method
+	}
 	agg := s.aggregation.Match(path)
-	log.Println("store: range", r, "agg", agg)
-	return r, s.driver.Get(path, r, agg)
+	if method == nil {
+		return path, agg, nil
+	}
+	if !agg.Has(*method) {
+		return "", nil, fmt.Errorf("store: %s is not aggregated by %v", path, *method)
+	}
+	return path, agg.For(*method), nil
+}
+
+// Options that change how a series is read. The zero value
+// picks everything automatically.
+type ReadOptions struct {
+	// Read from the bucket with this rollup, rather than
+	// the finest one that retains the whole range
+	Resolution time.Duration
+	// Return at most this many points, by picking a coarser
+	// bucket, or consolidating when there is none
+	MaxDataPoints int
+	// How to consolidate points, rather than by the
+	// aggregation method being read
+	ConsolidateBy *aggregate.Method
+	// Which of the methods a series is aggregated by to read,
+	// rather than the first. A path:method suffix takes precedence.
+	Method *aggregate.Method
+}
+
+func (s *Store) GetRange(path string, from, to int, opts ReadOptions) (*schema.Range, error) {
+	if opts.Resolution > 0 {
+		return s.schema.GetRangeAtResolution(path, from, to, opts.Resolution)
+	}
+	return s.schema.GetRange(path, from, to, int(time.Now().Unix()), opts.MaxDataPoints), nil
+}
+
+// consolidate brings data down to at most opts.MaxDataPoints points,
+// releasing the original data if it had to.
+func (s *Store) consolidate(agg *aggregate.Rule, r *schema.Range, data NullFloat64s, opts ReadOptions) (*schema.Range, NullFloat64s) {
+	if opts.MaxDataPoints <= 0 || data == nil || len(data) <= opts.MaxDataPoints {
+		return r, data
+	}
+	method := agg.Method
+	if opts.ConsolidateBy != nil {
+		method = *opts.ConsolidateBy
+	}
+	factor := (len(data) + opts.MaxDataPoints - 1) / opts.MaxDataPoints
+	out := schema.NewRange(int(r.Start), int(r.End), r.Rollup*factor)
+	// Aligning to the coarser step can add a point on either end
+	for out.Len() > opts.MaxDataPoints {
+		factor++
+		out = schema.NewRange(int(r.Start), int(r.End), r.Rollup*factor)
+	}
+	out.Period = r.Period
+	consolidated := Consolidate(data, r, out, method, agg.XFilesFactor)
+	data.Release()
+	return out, consolidated
+}
+
+// Get reads a series over a time range. When err is set, data
+// may still hold whatever could be read.
+func (s *Store) Get(path string, from, to int, opts ReadOptions) (*schema.Range, NullFloat64s, error) {
+	path, agg, err := s.readRule(path, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := s.GetRange(path, from, to, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Println("store: range", r, "agg", agg, agg.Method)
+	data, err := s.read(path, r, agg)
+	if err != nil {
+		log.Println("store:", path, r, err)
+	}
+	if slots := s.finerSlots(path, r, agg); slots > 0 {
+		samples, _ := s.samples(path, r, agg)
+		dropSparse(data, samples, slots, agg.XFilesFactor)
+		samples.Release()
+	}
+	r, data = s.consolidate(agg, r, data, opts)
+	return r, data, err
+}
+
+// read gets a range from the Driver, serving whatever it can
+// from the cache and hot window when there are those.
+func (s *Store) read(path string, r *schema.Range, agg *aggregate.Rule) (NullFloat64s, error) {
+	now := int(time.Now().Unix())
+	plan := s.plan(path, r, agg, now)
+	sub := plan.stored(r)
+	if sub == nil {
+		return plan.join(r, nil), nil
+	}
+	stored := storagePath(path, agg)
+	data, err := s.driver.Get(stored, sub, agg)
+	if err == nil && s.cache != nil {
+		s.cache.fill(stored, sub, data, s.settled(now))
+	}
+	return plan.join(r, data), err
+}
+
+// A read of one series, split into what's cached, what's held
+// in the hot window, and what's left to read from the Driver
+type readPlan struct {
+	prefix, recent NullFloat64s
+	// The part left for the Driver
+	lower, upper int
+}
+
+func (s *Store) plan(path string, r *schema.Range, agg *aggregate.Rule, now int) *readPlan {
+	p := &readPlan{lower: r.Lower, upper: r.Upper}
+	if s.hot != nil {
+		p.upper, p.recent = s.hot.Get(path, r, agg.Method, now)
+	}
+	if s.cache != nil {
+		p.prefix, p.lower = s.cache.lookup(storagePath(path, agg), r, s.settled(now))
+	}
+	return p
+}
+
+// settled is how far back from now slots no longer change. With
+// downsampling, coarser slots are only written once rolled up.
+func (s *Store) settled(now int) int {
+	if s.rollup != nil {
+		return now - int((ROLLUP_DELAY + s.rollup.interval).Seconds())
+	}
+	return now
+}
+
+// stored is the part of r to read from the Driver, nil if there's
+// nothing left. It reaches one slot into the hot window, since
+// Drivers never fill the very last slot of a range.
+func (p *readPlan) stored(r *schema.Range) *schema.Range {
+	if p.lower >= p.upper {
+		return nil
+	}
+	sub := *r
+	sub.Lower, sub.Upper = p.lower, p.upper
+	if sub.Upper < r.Upper {
+		sub.Upper += r.Rollup
+	}
+	return &sub
+}
+
+// join puts the series back together from what was cached, data
+// read from the Driver over stored, and the hot window
+func (p *readPlan) join(r *schema.Range, data NullFloat64s) NullFloat64s {
+	series := make(NullFloat64s, r.Len())
+	copy(series, p.prefix)
+	n := (p.upper - r.Lower) / r.Rollup
+	for i, v := range data {
+		if j := len(p.prefix) + i; j < n {
+			series[j] = v
+		} else if v != nil {
+			v.Release()
+		}
+	}
+	if p.recent != nil {
+		for j := n; j < len(series); j++ {
+			if series[j] != nil {
+				series[j].Release()
+			}
+			series[j] = p.recent[j]
+		}
+	}
+	return series
+}
+
+// Result of reading a single series with GetMany
+type Result struct {
+	Path  string
+	Range *schema.Range
+	Data  NullFloat64s
+	Err   error
+}
+
+// GetMany reads many series over the same time range, sending each
+// result as soon as it's read. Series that end up in the same bucket
+// with the same aggregation are read by the Driver together. The
+// channel is closed once every path has been sent, with each Result
+// keeping the path exactly as it was asked for.
+func (s *Store) GetMany(paths []string, from, to int, opts ReadOptions) <-chan *Result {
+	type group struct {
+		r     *schema.Range
+		agg   *aggregate.Rule
+		paths []string
+		// Every way each path was asked for, e.g. a and a:avg
+		asked map[string][]string
+	}
+	results := make(chan *Result, len(paths))
+	groups := make(map[string]*group)
+	seen := make(map[string]bool)
+	var failed []*Result
+	for _, target := range paths {
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		path, agg, err := s.readRule(target, opts)
+		if err != nil {
+			failed = append(failed, &Result{Path: target, Err: err})
+			continue
+		}
+		r, err := s.GetRange(path, from, to, opts)
+		if err != nil {
+			failed = append(failed, &Result{Path: target, Err: err})
+			continue
+		}
+		key := fmt.Sprintf("%v %v", *r, agg.Method)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{r, agg, nil, make(map[string][]string)}
+			groups[key] = g
+		}
+		if _, ok := g.asked[path]; !ok {
+			g.paths = append(g.paths, path)
+		}
+		g.asked[path] = append(g.asked[path], target)
+	}
+
+	var wg sync.WaitGroup
+	for _, g := range groups {
+		wg.Add(1)
+		go func(g *group) {
+			defer wg.Done()
+			samples := s.readSamples(g.paths, g.r, g.agg)
+			s.readMany(g.paths, g.r, g.agg, func(res *Result) {
+				if res.Err != nil {
+					log.Println("store:", res.Path, res.Range, res.Err)
+				}
+				if data, ok := samples[res.Path]; ok {
+					dropSparse(res.Data, data, s.finerSlots(res.Path, g.r, g.agg), g.agg.XFilesFactor)
+					data.Release()
+				}
+				res.Range, res.Data = s.consolidate(g.agg, res.Range, res.Data, opts)
+				asked := g.asked[res.Path]
+				for _, target := range asked[1:] {
+					data := make(NullFloat64s, len(res.Data))
+					for i, v := range res.Data {
+						if v != nil {
+							data[i] = NewNullFloat64(v.Float64, v.Valid)
+						}
+					}
+					results <- &Result{target, res.Range, data, res.Err}
+				}
+				res.Path = asked[0]
+				results <- res
+			})
+		}(g)
+	}
+	go func() {
+		for _, res := range failed {
+			results <- res
+		}
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// sampler is implemented by Drivers that keep how many points went
+// into each slot of an AVG series, which xFilesFactor is checked against
+type sampler interface {
+	// GetSamples reads the number of points in each slot of r
+	// for the AVG series stored under path
+	GetSamples(path string, r *schema.Range) (NullFloat64s, error)
+}
+
+// finerSlots is how many slots of the finest bucket of path fall in each
+// slot of r, or zero if there's nothing to check against the xFilesFactor
+// of agg. A point is expected to be written for each of them.
+func (s *Store) finerSlots(path string, r *schema.Range, agg *aggregate.Rule) int {
+	if agg.XFilesFactor <= 0 || agg.Method == aggregate.COUNT || !s.sampled(agg) {
+		return 0
+	}
+	finest := 0
+	for _, b := range s.GetBuckets(path) {
+		if rollup := int(b.Rollup.Seconds()); finest == 0 || rollup < finest {
+			finest = rollup
+		}
+	}
+	if finest == 0 || r.Rollup <= finest {
+		return 0
+	}
+	return r.Rollup / finest
+}
+
+// sampled reports whether the number of points in each slot of a series
+// can be read, either from its COUNT or the count its AVG keeps
+func (s *Store) sampled(agg *aggregate.Rule) bool {
+	if agg.Has(aggregate.COUNT) {
+		return true
+	}
+	_, ok := s.driver.(sampler)
+	return ok && agg.Has(aggregate.AVG)
+}
+
+// samples reads the number of points in each slot of r for path
+func (s *Store) samples(path string, r *schema.Range, agg *aggregate.Rule) (NullFloat64s, error) {
+	if agg.Has(aggregate.COUNT) {
+		return s.read(path, r, agg.For(aggregate.COUNT))
+	}
+	return s.driver.(sampler).GetSamples(storagePath(path, agg.For(aggregate.AVG)), r)
+}
+
+// readSamples reads the number of points in each slot for every
+// path that needs them to be checked against xFilesFactor
+func (s *Store) readSamples(paths []string, r *schema.Range, agg *aggregate.Rule) map[string]NullFloat64s {
+	var needed []string
+	for _, path := range paths {
+		if s.finerSlots(path, r, agg) > 0 {
+			needed = append(needed, path)
+		}
+	}
+	samples := make(map[string]NullFloat64s, len(needed))
+	if len(needed) == 0 {
+		return samples
+	}
+	if agg.Has(aggregate.COUNT) {
+		s.readMany(needed, r, agg.For(aggregate.COUNT), func(res *Result) {
+			samples[res.Path] = res.Data
+		})
+		return samples
+	}
+	for _, path := range needed {
+		samples[path], _ = s.samples(path, r, agg)
+	}
+	return samples
+}
+
+// dropSparse nulls every slot of data where fewer than xFilesFactor of
+// the slots finer than it have a point, going by the samples counted.
+// Series written before samples were counted have none at all, and
+// are left alone.
+func dropSparse(data, samples NullFloat64s, slots int, xFilesFactor float64) {
+	known := false
+	for _, n := range samples {
+		if n != nil && n.Valid {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return
+	}
+	for i, v := range data {
+		if v == nil || i >= len(samples) {
+			continue
+		}
+		if n := samples[i]; n == nil || !n.Valid || n.Float64/float64(slots) < xFilesFactor {
+			v.Release()
+			data[i] = nil
+		}
+	}
+}
+
+// readMany is read for many paths over the same range. Paths left with
+// the same part to read from the Driver are read together, which for
+// a dashboard refreshing is usually all of them.
+func (s *Store) readMany(paths []string, r *schema.Range, agg *aggregate.Rule, send func(*Result)) {
+	now := int(time.Now().Unix())
+	plans := make(map[string]*readPlan, len(paths))
+	groups := make(map[[2]int][]string)
+	for _, path := range paths {
+		plan := s.plan(path, r, agg, now)
+		if plan.lower >= plan.upper {
+			send(&Result{Path: path, Range: r, Data: plan.join(r, nil)})
+			continue
+		}
+		plans[path] = plan
+		key := [2]int{plan.lower, plan.upper}
+		groups[key] = append(groups[key], path)
+	}
+	for _, paths := range groups {
+		sub := plans[paths[0]].stored(r)
+		stored := make([]string, len(paths))
+		byStored := make(map[string]string, len(paths))
+		for i, path := range paths {
+			stored[i] = storagePath(path, agg)
+			byStored[stored[i]] = path
+		}
+		raw := make(chan *Result)
+		go func() {
+			s.driver.GetMany(stored, sub, agg, raw)
+			close(raw)
+		}()
+		for res := range raw {
+			if res.Err == nil && s.cache != nil {
+				s.cache.fill(res.Path, sub, res.Data, s.settled(now))
+			}
+			res.Path = byStored[res.Path]
+			res.Data = plans[res.Path].join(r, res.Data)
+			res.Range = r
+			send(res)
+		}
+	}
+}
+
+// GetSegments reads a series from the finest bucket that still has
+// data for each part of the time range, finest and most recent first.
+// See Stitch to join them into a single series.
+func (s *Store) GetSegments(path string, from, to int, opts ReadOptions) (Segments, error) {
+	path, agg, err := s.readRule(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return s.segments(path, agg, from, to)
+}
+
+func (s *Store) segments(path string, agg *aggregate.Rule, from, to int) (Segments, error) {
+	ranges := s.schema.GetRanges(path, from, to, int(time.Now().Unix()))
+	segments := make(Segments, len(ranges))
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r *schema.Range) {
+			defer wg.Done()
+			data, err := s.read(path, r, agg)
+			if data == nil {
+				data = make(NullFloat64s, r.Len())
+			}
+			if slots := s.finerSlots(path, r, agg); slots > 0 {
+				samples, _ := s.samples(path, r, agg)
+				dropSparse(data, samples, slots, agg.XFilesFactor)
+				samples.Release()
+			}
+			segments[i] = &Segment{r, data}
+			errs[i] = err
+		}(i, r)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			log.Println("store:", path, err)
+			return segments, err
+		}
+	}
+	return segments, nil
+}
+
+// GetStitched is like Get, but fills each part of the range from the
+// finest bucket that still has it, consolidated to a single step.
+// Resolution is ignored, since every bucket may be used.
+func (s *Store) GetStitched(path string, from, to int, opts ReadOptions) (*schema.Range, NullFloat64s, error) {
+	path, agg, err := s.readRule(path, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	segments, err := s.segments(path, agg, from, to)
+	defer segments.Release()
+	if len(segments) == 0 {
+		opts.Resolution = 0
+		opts.Method = &agg.Method
+		return s.Get(path, from, to, opts)
+	}
+	r, data := Stitch(segments, from, to, agg.Method)
+	r, data = s.consolidate(agg, r, data, opts)
+	return r, data, err
 }
 
 func (s *Store) GetBuckets(path string) []*schema.Bucket {
@@ -68,6 +605,12 @@ func (s *Store) GetBuckets(path string) []*schema.Bucket {
 }
 
 func (s *Store) Close() {
+	if s.rollup != nil {
+		s.rollup.Close()
+	}
+	if s.batcher != nil {
+		s.batcher.Close()
+	}
 	if s.driver != nil {
 		s.driver.Close()
 	}
@@ -85,8 +628,129 @@ func (s *Store) Ping() bool {
 	return true
 }
 
+// RetentionStats reports how much expired data the Driver has reclaimed,
+// false if it doesn't need to, or isn't configured to, enforce retention.
+func (s *Store) RetentionStats() (RetentionStats, bool) {
+	if r, ok := s.driver.(RetentionReporter); ok {
+		return r.RetentionStats()
+	}
+	return RetentionStats{}, false
+}
+
+// CacheStats reports how reads are being served from the
+// cache, false if there isn't one.
+func (s *Store) CacheStats() (CacheStats, bool) {
+	if s.cache == nil {
+		return CacheStats{}, false
+	}
+	return s.cache.Stats(), true
+}
+
+// DedupeStats reports how many samples were dropped as
+// duplicates, false if deduplication isn't enabled.
+func (s *Store) DedupeStats() (DedupeStats, bool) {
+	if s.dedupe == nil {
+		return DedupeStats{}, false
+	}
+	return s.dedupe.Stats(), true
+}
+
+// failed reports a point the Driver failed to write, and forgets it was
+// seen, so that it isn't dropped as a duplicate when it's sent again
+func (s *Store) failed(e *WriteError) {
+	s.errors.Report(e)
+	if s.dedupe != nil {
+		s.dedupe.Forget(seriesPath(e.Path), e.Timestamp, e.Value)
+	}
+}
+
+// WriteStats reports how many points the Driver failed to write
+func (s *Store) WriteStats() WriteStats {
+	return s.errors.Stats()
+}
+
+// SetWriteErrors sends every point the Driver fails to write to errs,
+// batched or not. When errs is full they're dropped, and counted in
+// WriteStats, rather than holding up writes.
+func (s *Store) SetWriteErrors(errs chan<- *WriteError) {
+	s.errors.mux.Lock()
+	s.errors.ch = errs
+	s.errors.mux.Unlock()
+}
+
+// SetCache serves closed blocks of past reads from cache,
+// or stops caching when cache is nil.
+func (s *Store) SetCache(cache *Cache) {
+	s.cache = cache
+}
+
+// SetHotWindow keeps the raw points written over the last window in
+// memory, up to about budget bytes, and serves reads of them from there.
+// Only points written through this Store are held, and reads of the
+// window don't go to the Driver at all, so it's only for a single
+// process taking every write.
+func (s *Store) SetHotWindow(window time.Duration, budget int64) {
+	s.hot = nil
+	if window > 0 && budget > 0 {
+		s.hot = newHotWindow(window, budget)
+	}
+}
+
+// SetDownsampling only writes the finest bucket of methods that can be
+// derived from it on ingest, and rolls up the coarser buckets every
+// interval once their slots have closed, checkpointing progress to file.
+// Only one process writing to a store may downsample it, since each of
+// them would add every rolled up slot to the counters again.
+// Stops downsampling when interval is 0.
+func (s *Store) SetDownsampling(interval time.Duration, file string) error {
+	if s.rollup != nil {
+		s.rollup.Close()
+		s.rollup = nil
+	}
+	if interval <= 0 {
+		return nil
+	}
+	r, err := newRollup(s, interval, file)
+	if err != nil {
+		return err
+	}
+	s.rollup = r
+	return nil
+}
+
+// SetDedupe drops samples identical, in path, timestamp and value, to one
+// written within the last window, remembering up to about budget bytes.
+func (s *Store) SetDedupe(window time.Duration, budget int64) {
+	s.dedupe = nil
+	if window > 0 && budget > 0 {
+		s.dedupe = newDeduper(window, budget)
+	}
+}
+
+// getDriver is the Driver being written to now, which
+// SetDriver may have changed since batching was set up
+func (s *Store) getDriver() Driver {
+	return s.driver
+}
+
 func (s *Store) SetDriver(driver Driver) {
 	s.driver = driver
+	if w, ok := driver.(asyncWriter); ok {
+		w.ReportWriteErrors(s.failed)
+	}
+}
+
+// SetBatching enables grouping writes per partition before they
+// are sent to the Driver. Each partition is flushed once size points
+// have been collected, or at least every interval.
+func (s *Store) SetBatching(size int, interval time.Duration) {
+	if s.batcher != nil {
+		s.batcher.Close()
+		s.batcher = nil
+	}
+	if size > 1 && interval > 0 {
+		s.batcher = newBatcher(s.getDriver, size, interval, s.failed)
+	}
 }
 
 func (s *Store) SetSchema(schema *schema.Schema) {
@@ -101,6 +765,202 @@ func (s *Store) SetIndexer(index *index.Store) {
 	s.index = index
 }
 
+// What was, or with a dry run would be, removed by Delete
+type DeleteResult struct {
+	// Series whose data was deleted
+	Paths []string
+	// Keys removed from the index, including emptied branches
+	Index []string
+	// Set when DryRun was requested and nothing was removed
+	DryRun bool
+}
+
+// Delete removes all data and index entries for every series
+// matching the query, which may be a glob.
+func (s *Store) Delete(query string, dryRun bool) (*DeleteResult, error) {
+	paths, err := s.index.QueryAll(query)
+	if err != nil {
+		return nil, err
+	}
+	result := &DeleteResult{
+		Paths:  make([]string, 0, len(paths)),
+		Index:  make([]string, 0),
+		DryRun: dryRun,
+	}
+	if dryRun {
+		for _, p := range paths {
+			result.Paths = append(result.Paths, p.Key)
+		}
+		if result.Index, err = s.index.WouldDelete(result.Paths); err != nil {
+			return result, err
+		}
+		log.Println("store: would delete", result.Paths)
+		return result, nil
+	}
+	for _, p := range paths {
+		if err = s.deleteData(p.Key); err != nil {
+			return result, err
+		}
+		if s.hot != nil {
+			s.hot.Remove(p.Key)
+		}
+		result.Paths = append(result.Paths, p.Key)
+		removed, err := s.index.Delete(p.Key)
+		result.Index = append(result.Index, removed...)
+		if err != nil {
+			return result, err
+		}
+	}
+	log.Println("store: deleted", result.Paths, "dry run:", dryRun)
+	return result, nil
+}
+
+type MoveOptions struct {
+	// Merge into destinations that already exist, using the
+	// aggregation method of the series. Otherwise an existing
+	// destination is an error.
+	Merge bool
+	// Delete each source after it has been copied
+	DeleteSource bool
+	// Only report what would be moved
+	DryRun bool
+}
+
+type MoveResult struct {
+	// Source path to destination path
+	Moved  map[string]string
+	DryRun bool
+}
+
+// Move copies every series matching query to a new path, built by
+// replacing the from prefix with to. An empty query moves just the
+// series at from, while a glob such as servers.web1.*.* moves that
+// whole subtree. A series can't be moved onto itself, or onto another
+// series being moved, since that would copy it and then delete it.
+func (s *Store) Move(query, from, to string, opts MoveOptions) (*MoveResult, error) {
+	if from == to {
+		return nil, fmt.Errorf("store: can't move %s onto itself", from)
+	}
+	if query == "" {
+		query = from
+	}
+	paths, err := s.index.QueryAll(query)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := make(map[string]string)
+	for _, p := range paths {
+		if p.Key != from && !strings.HasPrefix(p.Key, from+".") {
+			return nil, fmt.Errorf("store: %s does not start with %s", p.Key, from)
+		}
+		dst := to + p.Key[len(from):]
+		if !sameStorage(s.schema.Match(p.Key), s.schema.Match(dst), s.aggregation.Match(p.Key), s.aggregation.Match(dst)) {
+			return nil, fmt.Errorf("store: %s and %s are stored differently", p.Key, dst)
+		}
+		if !opts.Merge {
+			existing, err := s.index.Query(dst)
+			if err != nil {
+				return nil, err
+			}
+			if len(existing) > 0 {
+				return nil, fmt.Errorf("store: %s already exists", dst)
+			}
+		}
+		moves[p.Key] = dst
+	}
+	for src, dst := range moves {
+		if _, ok := moves[dst]; ok {
+			return nil, fmt.Errorf("store: %s would be moved onto %s, which is also being moved", src, dst)
+		}
+	}
+
+	result := &MoveResult{Moved: make(map[string]string), DryRun: opts.DryRun}
+	if opts.DryRun {
+		result.Moved = moves
+		return result, nil
+	}
+	for src, dst := range moves {
+		buckets, agg := s.GetBuckets(src), s.aggregation.Match(src)
+		for _, method := range agg.Methods {
+			rule := agg.For(method)
+			if err = s.driver.Copy(storagePath(src, rule), storagePath(dst, rule), buckets, rule); err != nil {
+				return result, err
+			}
+		}
+		// What was cached for dst no longer has everything
+		s.forgetCache(dst)
+		if err = s.index.Update(dst); err != nil {
+			return result, err
+		}
+		if opts.DeleteSource {
+			if err = s.deleteData(src); err != nil {
+				return result, err
+			}
+			if s.hot != nil {
+				s.hot.Remove(src)
+			}
+			if _, err = s.index.Delete(src); err != nil {
+				return result, err
+			}
+		}
+		result.Moved[src] = dst
+		log.Println("store: moved", src, "to", dst)
+	}
+	return result, nil
+}
+
+// deleteData removes every method a series is aggregated by
+func (s *Store) deleteData(path string) error {
+	buckets, agg := s.GetBuckets(path), s.aggregation.Match(path)
+	for _, method := range agg.Methods {
+		rule := agg.For(method)
+		if err := s.driver.Delete(storagePath(path, rule), buckets, rule); err != nil {
+			return err
+		}
+	}
+	if s.rollup != nil {
+		s.rollup.Forget(path)
+	}
+	s.forgetCache(path)
+	return nil
+}
+
+// forgetCache drops every cached block of path that could still
+// hold data, for when it's been deleted or merged into
+func (s *Store) forgetCache(path string) {
+	if s.cache == nil {
+		return
+	}
+	now := int(time.Now().Unix())
+	agg := s.aggregation.Match(path)
+	for _, b := range s.GetBuckets(path) {
+		r := b.Range(now-int(b.Ttl.Seconds()), now)
+		for _, method := range agg.Methods {
+			s.cache.forget(storagePath(path, agg.For(method)), r)
+		}
+	}
+}
+
+// Data can only be copied between paths that share buckets and
+// aggregation method, otherwise it'd end up where nothing reads it
+func sameStorage(a, b *schema.Rule, aggA, aggB *aggregate.Rule) bool {
+	if len(aggA.Methods) != len(aggB.Methods) || len(a.Buckets) != len(b.Buckets) {
+		return false
+	}
+	for i := range aggA.Methods {
+		if aggA.Methods[i] != aggB.Methods[i] {
+			return false
+		}
+	}
+	for i := range a.Buckets {
+		if *a.Buckets[i] != *b.Buckets[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Store) GetChildren(path string) ([]*index.Path, error) {
 	return s.index.GetChildren(path)
 }
@@ -112,33 +972,71 @@ func (s *Store) QueryIndex(query string) ([]*index.Path, error) {
 type Driver interface {
 	Init(*url.URL) error
 	WriteToBucket(*metric.Point, *aggregate.Rule, *schema.Bucket) error
-	Get(string, *schema.Range, *aggregate.Rule) NullFloat64s
+	// Write many points for the same path into a single bucket.
+	// Returns one error per point, nil if that point was written.
+	WriteBatchToBucket(string, metric.Points, *aggregate.Rule, *schema.Bucket) []error
+	// Read a range, returning partial results alongside any error
+	Get(string, *schema.Range, *aggregate.Rule) (NullFloat64s, error)
+	// Read the same range of many paths, sending one Result per path
+	GetMany([]string, *schema.Range, *aggregate.Rule, chan<- *Result)
+	// Remove all data for a path, across all of its buckets
+	Delete(string, []*schema.Bucket, *aggregate.Rule) error
+	// Merge all data from one path into another, across all buckets
+	Copy(string, string, []*schema.Bucket, *aggregate.Rule) error
 	Ping() error
 	Close()
 }
 
-func Register(key string, d Driver) {
-	registry[key] = d
+// Drivers that hold writes back, and so can only report the
+// ones that fail later on, once they're actually written
+type asyncWriter interface {
+	ReportWriteErrors(func(*WriteError))
 }
 
-func GetDriver(url *url.URL) Driver {
-	d, ok := registry[url.Scheme]
+// Drivers that enforce retention themselves, rather than
+// relying on a TTL, can report on what they've reclaimed
+type RetentionReporter interface {
+	RetentionStats() (RetentionStats, bool)
+}
+
+// Register makes a Driver available under a url scheme. Each
+// connection gets a Driver of its own from newDriver.
+func Register(key string, newDriver func() Driver) {
+	registry[key] = newDriver
+}
+
+// OpenDriver returns a new Driver connected to url
+func OpenDriver(url *url.URL) (Driver, error) {
+	newDriver, ok := registry[url.Scheme]
 	if !ok {
-		panic("store: driver not found")
+		return nil, fmt.Errorf("store: driver %q not found", url.Scheme)
+	}
+	d := newDriver()
+	if err := d.Init(url); err != nil {
+		return nil, err
 	}
-	err := d.Init(url)
+	return d, nil
+}
+
+func GetDriver(url *url.URL) Driver {
+	d, err := OpenDriver(url)
 	if err != nil {
 		panic(err)
 	}
 	return d
 }
 
+func New(driver Driver) *Store {
+	s := &Store{}
+	s.SetDriver(driver)
+	return s
+}
+
 func NewFromConnection(url *url.URL) *Store {
-	d := GetDriver(url)
-	return &Store{driver: d}
+	return New(GetDriver(url))
 }
 
-var registry = make(map[string]Driver)
+var registry = make(map[string]func() Driver)
 
 type NullFloat64 struct {
 	Float64 float64
@@ -0,0 +1,487 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/aggregate"
+	log "github.com/mattrobenolt/mineshaft/logging"
+	"github.com/mattrobenolt/mineshaft/metric"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many writes can be waiting for each secondary before more are dropped
+const TEE_QUEUE_SIZE = 100000
+
+// How many writes to each secondary are running at once. Each worker
+// has its own share of the queue, and every series is always written
+// by the same one, so its writes land in the order they were made.
+const TEE_WORKERS = 20
+
+// How many reads are compared at once, reads beyond that aren't compared
+const TEE_MAX_COMPARES = 10
+
+// How often tee stats are logged, when anything has changed
+const TEE_LOG_INTERVAL = time.Minute
+
+// TeeDriver writes to a primary Driver, and to any number of secondaries,
+// for moving between clusters, or layouts, without downtime. Writes to the
+// primary happen as they would without the tee, while those to each
+// secondary are queued, so a slow or failing secondary only fills its own
+// queue, and drops writes once that's full, rather than holding up
+// ingestion. Deletes and copies are queued behind the writes to the same
+// series, so none of those can land after them, and wait for room rather
+// than being dropped.
+//
+// Reads come from the preferred driver, and with compare set, are read
+// from the primary, or the first secondary when reading from the primary,
+// too, with any slots that differ logged. Secondaries lag behind by
+// however much they have queued, so the most recent slots can differ
+// without anything being wrong.
+type TeeDriver struct {
+	primary     Driver
+	secondaries []*teeSecondary
+	read        Driver
+	compareTo   Driver
+	compares    chan struct{}
+
+	compared, differed int64
+	done               chan struct{}
+	wg                 sync.WaitGroup
+}
+
+type teeSecondary struct {
+	name   string
+	driver Driver
+	queues []chan func() error
+
+	queued, dropped, failed int64
+	wg                      sync.WaitGroup
+}
+
+// Init opens each of the drivers, given as escaped urls, e.g.
+//
+//	tee://?primary=cassandra%3A%2F%2Fold%2Fmetrics&secondary=cassandra%3A%2F%2Fnew%2Fmetrics%3Flayout%3Dchunks
+//
+// Supported query parameters:
+//
+//	primary     url of the driver writes are made to first
+//	secondary   url of another driver to write to, may be repeated
+//	read        driver to read from: primary, the default, secondary
+//	            for the first secondary, or its index among them all,
+//	            counting from the primary as 0
+//	compare     true to compare every read with another driver
+//	queue_size  writes each secondary can have waiting, default TEE_QUEUE_SIZE,
+//	            split evenly between its workers
+func (d *TeeDriver) Init(u *url.URL) error {
+	q := u.Query()
+	open := func(raw string) (Driver, error) {
+		parsed, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		return OpenDriver(parsed)
+	}
+	if q.Get("primary") == "" || len(q["secondary"]) == 0 {
+		return fmt.Errorf("store/tee: needs a primary and at least one secondary")
+	}
+	queueSize := TEE_QUEUE_SIZE
+	if v := q.Get("queue_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("store/tee: invalid queue_size %q", v)
+		}
+		queueSize = n
+	}
+
+	var err error
+	if d.primary, err = open(q.Get("primary")); err != nil {
+		return err
+	}
+	drivers := []Driver{d.primary}
+	d.done = make(chan struct{})
+	for _, raw := range q["secondary"] {
+		driver, err := open(raw)
+		if err != nil {
+			d.Close()
+			return err
+		}
+		drivers = append(drivers, driver)
+		sec := &teeSecondary{
+			name:   redactedURL(raw),
+			driver: driver,
+			queues: make([]chan func() error, TEE_WORKERS),
+		}
+		for i := range sec.queues {
+			size := queueSize / TEE_WORKERS
+			if size < 1 {
+				size = 1
+			}
+			sec.queues[i] = make(chan func() error, size)
+			sec.wg.Add(1)
+			go sec.run(sec.queues[i])
+		}
+		d.secondaries = append(d.secondaries, sec)
+	}
+
+	read := 0
+	switch v := q.Get("read"); v {
+	case "", "primary":
+	case "secondary":
+		read = 1
+	default:
+		if read, err = strconv.Atoi(v); err != nil || read < 0 || read >= len(drivers) {
+			d.Close()
+			return fmt.Errorf("store/tee: invalid read %q", v)
+		}
+	}
+	d.read = drivers[read]
+	if compare, _ := strconv.ParseBool(q.Get("compare")); compare {
+		d.compareTo = d.primary
+		if read == 0 {
+			d.compareTo = drivers[1]
+		}
+		d.compares = make(chan struct{}, TEE_MAX_COMPARES)
+	}
+	d.wg.Add(1)
+	go d.logStats()
+	return nil
+}
+
+// redactedURL is a url without its credentials, for logging
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "invalid url"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+func (s *teeSecondary) run(queue chan func() error) {
+	defer s.wg.Done()
+	for write := range queue {
+		if err := write(); err != nil {
+			atomic.AddInt64(&s.failed, 1)
+			log.Println("store/tee:", s.name, err)
+		}
+	}
+}
+
+// queueFor is the queue of the worker writing every method of path's series
+func (s *teeSecondary) queueFor(path string) chan func() error {
+	h := fnv.New32a()
+	h.Write([]byte(seriesPath(path)))
+	return s.queues[h.Sum32()%uint32(len(s.queues))]
+}
+
+// enqueue queues a write to path, dropping it when the queue is full
+func (s *teeSecondary) enqueue(path string, write func() error) {
+	select {
+	case s.queueFor(path) <- write:
+		atomic.AddInt64(&s.queued, 1)
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// wait queues a write to path, waiting for room when the queue is full
+func (s *teeSecondary) wait(path string, write func() error) {
+	s.queueFor(path) <- write
+	atomic.AddInt64(&s.queued, 1)
+}
+
+func copyPoint(p *metric.Point) *metric.Point {
+	c := metric.New()
+	c.SetPath(p.GetPath())
+	c.SetValue(p.GetValue())
+	c.SetTimestamp(p.GetTimestamp())
+	return c
+}
+
+func (d *TeeDriver) WriteToBucket(p *metric.Point, agg *aggregate.Rule, b *schema.Bucket) error {
+	for _, sec := range d.secondaries {
+		// The caller releases p once we return
+		c := copyPoint(p)
+		driver := sec.driver
+		sec.enqueue(p.GetPath(), func() error {
+			defer c.Release()
+			return driver.WriteToBucket(c, agg, b)
+		})
+	}
+	return d.primary.WriteToBucket(p, agg, b)
+}
+
+func (d *TeeDriver) WriteBatchToBucket(path string, points metric.Points, agg *aggregate.Rule, b *schema.Bucket) []error {
+	for _, sec := range d.secondaries {
+		copied := make(metric.Points, len(points))
+		for i, p := range points {
+			copied[i] = copyPoint(p)
+		}
+		driver := sec.driver
+		sec.enqueue(path, func() error {
+			defer copied.Release()
+			for _, err := range driver.WriteBatchToBucket(path, copied, agg, b) {
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return d.primary.WriteBatchToBucket(path, points, agg, b)
+}
+
+// SetBucket backfills every driver that supports it
+func (d *TeeDriver) SetBucket(path string, slots map[uint32]*accumulator, agg *aggregate.Rule, b *schema.Bucket) error {
+	primary, ok := d.primary.(backfiller)
+	if !ok {
+		return fmt.Errorf("store: %T can't backfill", d.primary)
+	}
+	for _, sec := range d.secondaries {
+		if driver, ok := sec.driver.(backfiller); ok {
+			sec.enqueue(path, func() error {
+				return driver.SetBucket(path, slots, agg, b)
+			})
+		}
+	}
+	return primary.SetBucket(path, slots, agg, b)
+}
+
+func (d *TeeDriver) Get(path string, r *schema.Range, agg *aggregate.Rule) (NullFloat64s, error) {
+	data, err := d.read.Get(path, r, agg)
+	if err == nil {
+		d.compare(path, r, agg, data)
+	}
+	return data, err
+}
+
+func (d *TeeDriver) GetSamples(path string, r *schema.Range) (NullFloat64s, error) {
+	smp, ok := d.read.(sampler)
+	if !ok {
+		return nil, fmt.Errorf("store: %T doesn't count samples", d.read)
+	}
+	return smp.GetSamples(path, r)
+}
+
+func (d *TeeDriver) GetMany(paths []string, r *schema.Range, agg *aggregate.Rule, results chan<- *Result) {
+	if d.compareTo == nil {
+		d.read.GetMany(paths, r, agg, results)
+		return
+	}
+	read := make(chan *Result)
+	go func() {
+		d.read.GetMany(paths, r, agg, read)
+		close(read)
+	}()
+	for res := range read {
+		if res.Err == nil {
+			d.compare(res.Path, r, agg, res.Data)
+		}
+		results <- res
+	}
+}
+
+// compare reads the same range from the other driver, in the background,
+// and logs where it differs from data. Reads are only compared while
+// fewer than TEE_MAX_COMPARES comparisons are running.
+func (d *TeeDriver) compare(path string, r *schema.Range, agg *aggregate.Rule, data NullFloat64s) {
+	if d.compareTo == nil {
+		return
+	}
+	select {
+	case d.compares <- struct{}{}:
+	default:
+		return
+	}
+	// The caller releases data, so hold on to a copy
+	values := make([]float64, len(data))
+	for i, v := range data {
+		values[i] = math.NaN()
+		if v != nil && v.Valid {
+			values[i] = v.Float64
+		}
+	}
+	go func() {
+		defer func() { <-d.compares }()
+		other, err := d.compareTo.Get(path, r, agg)
+		defer other.Release()
+		if err != nil {
+			log.Println("store/tee: compare", path, err)
+			return
+		}
+		atomic.AddInt64(&d.compared, 1)
+		diffs, first := 0, -1
+		for i := 0; i < len(values) || i < len(other); i++ {
+			a, b := math.NaN(), math.NaN()
+			if i < len(values) {
+				a = values[i]
+			}
+			if i < len(other) && other[i] != nil && other[i].Valid {
+				b = other[i].Float64
+			}
+			if a == b || (math.IsNaN(a) && math.IsNaN(b)) {
+				continue
+			}
+			if first < 0 {
+				first = i
+			}
+			diffs++
+		}
+		if diffs == 0 {
+			return
+		}
+		atomic.AddInt64(&d.differed, 1)
+		a, b := math.NaN(), math.NaN()
+		if first < len(values) {
+			a = values[first]
+		}
+		if first < len(other) && other[first] != nil && other[first].Valid {
+			b = other[first].Float64
+		}
+		log.Println("store/tee:", path, agg.Method, "differs in", diffs, "of", len(values), "slots, first at", r.Lower+first*r.Rollup, a, "vs", b)
+	}()
+}
+
+// Delete removes path from every driver, only failing on the primary.
+// Secondaries delete once the writes to path queued before it are done.
+func (d *TeeDriver) Delete(path string, buckets []*schema.Bucket, agg *aggregate.Rule) error {
+	for _, sec := range d.secondaries {
+		driver := sec.driver
+		sec.wait(path, func() error {
+			return driver.Delete(path, buckets, agg)
+		})
+	}
+	return d.primary.Delete(path, buckets, agg)
+}
+
+// Copy copies within every driver, only failing on the primary.
+// Secondaries copy once the writes to from queued before it are done,
+// while writes to to are merged with the copy in whatever order.
+func (d *TeeDriver) Copy(from, to string, buckets []*schema.Bucket, agg *aggregate.Rule) error {
+	for _, sec := range d.secondaries {
+		driver := sec.driver
+		sec.wait(from, func() error {
+			return driver.Copy(from, to, buckets, agg)
+		})
+	}
+	return d.primary.Copy(from, to, buckets, agg)
+}
+
+// Ping fails when the primary, or the driver read from, does.
+// Secondaries that fail are only logged.
+func (d *TeeDriver) Ping() error {
+	if err := d.primary.Ping(); err != nil {
+		return err
+	}
+	for _, sec := range d.secondaries {
+		if err := sec.driver.Ping(); err != nil {
+			if sec.driver == d.read {
+				return err
+			}
+			log.Println("store/tee:", sec.name, err)
+		}
+	}
+	return nil
+}
+
+// RetentionStats reports on the primary
+func (d *TeeDriver) RetentionStats() (RetentionStats, bool) {
+	if r, ok := d.primary.(RetentionReporter); ok {
+		return r.RetentionStats()
+	}
+	return RetentionStats{}, false
+}
+
+type TeeStats struct {
+	// Reads compared, and how many of those differed
+	Compared, Differed int64
+	Secondaries        []TeeSecondaryStats
+}
+
+type TeeSecondaryStats struct {
+	Name string
+	// Writes queued, and dropped because the queue was full
+	Queued, Dropped int64
+	// Writes that failed
+	Failed int64
+	// Writes currently waiting
+	Waiting int
+}
+
+func (d *TeeDriver) Stats() TeeStats {
+	stats := TeeStats{
+		Compared: atomic.LoadInt64(&d.compared),
+		Differed: atomic.LoadInt64(&d.differed),
+	}
+	for _, sec := range d.secondaries {
+		waiting := 0
+		for _, queue := range sec.queues {
+			waiting += len(queue)
+		}
+		stats.Secondaries = append(stats.Secondaries, TeeSecondaryStats{
+			Name:    sec.name,
+			Queued:  atomic.LoadInt64(&sec.queued),
+			Dropped: atomic.LoadInt64(&sec.dropped),
+			Failed:  atomic.LoadInt64(&sec.failed),
+			Waiting: waiting,
+		})
+	}
+	return stats
+}
+
+func (d *TeeDriver) logStats() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(TEE_LOG_INTERVAL)
+	defer ticker.Stop()
+	var last TeeStats
+	for {
+		select {
+		case <-ticker.C:
+			stats := d.Stats()
+			if fmt.Sprint(stats) != fmt.Sprint(last) {
+				log.Println("store/tee:", fmt.Sprintf("%+v", stats))
+			}
+			last = stats
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// ReportWriteErrors passes report on to the primary, failures of
+// the secondaries are only counted in the tee's own stats
+func (d *TeeDriver) ReportWriteErrors(report func(*WriteError)) {
+	if w, ok := d.primary.(asyncWriter); ok {
+		w.ReportWriteErrors(report)
+	}
+}
+
+// Close waits for every secondary to write what it has queued
+func (d *TeeDriver) Close() {
+	if d.done != nil {
+		close(d.done)
+		d.wg.Wait()
+	}
+	for _, sec := range d.secondaries {
+		for _, queue := range sec.queues {
+			close(queue)
+		}
+		sec.wg.Wait()
+		sec.driver.Close()
+	}
+	if d.primary != nil {
+		d.primary.Close()
+	}
+}
+
+func init() {
+	Register("tee", func() Driver { return &TeeDriver{} })
+}
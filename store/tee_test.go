@@ -0,0 +1,60 @@
+package store
+
+import (
+	"github.com/mattrobenolt/mineshaft/metric"
+	"github.com/mattrobenolt/mineshaft/schema"
+
+	"net/url"
+	"testing"
+)
+
+func openTee(t *testing.T, primary, secondary string) *TeeDriver {
+	u, err := url.Parse("tee://?primary=" + url.QueryEscape("memory://"+primary) + "&secondary=" + url.QueryEscape("memory://"+secondary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := OpenDriver(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d.(*TeeDriver)
+}
+
+func TestTeeOrdered(t *testing.T) {
+	s, _ := newMemoryStore(t, "1min:1d", "last")
+	bucket := s.GetBuckets("a.x")[0]
+	last := s.aggregation.Match("a.x")
+
+	tee := openTee(t, "ordered-primary", "ordered-secondary")
+	for i := 0; i < 1000; i++ {
+		for _, path := range []string{"a.x", "a.y", "b.z"} {
+			p := metric.New()
+			p.SetPath(path)
+			p.SetTimestamp(6000)
+			p.SetValue(float64(i))
+			if err := tee.WriteToBucket(p, last, bucket); err != nil {
+				t.Fatal(err)
+			}
+			p.Release()
+		}
+	}
+	// Written after every write to a.y, and before any more
+	if err := tee.Copy("a.y", "a.w", []*schema.Bucket{bucket}, last); err != nil {
+		t.Fatal(err)
+	}
+	if err := tee.Delete("b.z", []*schema.Bucket{bucket}, last); err != nil {
+		t.Fatal(err)
+	}
+	tee.Close()
+
+	primary, secondary := memoryDrivers["ordered-primary"], memoryDrivers["ordered-secondary"]
+	for _, path := range []string{"a.x", "a.y", "a.w"} {
+		want, _ := primary.value(path, 6000, bucket, last.Method)
+		if got, ok := secondary.value(path, 6000, bucket, last.Method); !ok || got != want {
+			t.Errorf("secondary %s = %v, want %v", path, got, want)
+		}
+	}
+	if v, ok := secondary.value("b.z", 6000, bucket, last.Method); ok {
+		t.Errorf("secondary b.z = %v after Delete", v)
+	}
+}